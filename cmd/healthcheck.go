@@ -0,0 +1,77 @@
+/*
+Copyright © 2022 Dominik Ágh <agh.dominik@gmail.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// healthcheckCmd represents the healthcheck command
+var healthcheckCmd = &cobra.Command{
+	Use:   "healthcheck",
+	Short: "Probes the readiness of a running server",
+	Long: `Requests the readiness endpoint of the server running with the same configuration
+and exits with a non-zero status, unless it's ready. It is meant for container health checks,
+where no HTTP client might be available.`,
+	Run: runHealthcheck,
+}
+
+func runHealthcheck(cmd *cobra.Command, args []string) {
+	target, _ := cmd.Flags().GetString("url")
+	if target == "" {
+		host := viper.GetString("server.host")
+		// A server listening on all interfaces is reachable on the loopback
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "127.0.0.1"
+		}
+		path := "/readyz"
+		if live, _ := cmd.Flags().GetBool("live"); live {
+			path = "/healthz"
+		}
+		target = "http://" + net.JoinHostPort(host, strconv.Itoa(viper.GetInt("server.port"))) + path
+	}
+	timeout, _ := cmd.Flags().GetDuration("timeout")
+
+	res, err := (&http.Client{Timeout: timeout}).Get(target)
+	cobra.CheckErr(err)
+	defer res.Body.Close()
+	io.Copy(os.Stdout, res.Body)
+	if res.StatusCode != http.StatusOK {
+		cobra.CheckErr(fmt.Errorf("%s responded with %s", target, res.Status))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(healthcheckCmd)
+	healthcheckCmd.Flags().String("url", "", "URL to probe instead of the configured server's readiness endpoint")
+	healthcheckCmd.Flags().Bool("live", false, "probe the liveness endpoint instead")
+	healthcheckCmd.Flags().Duration("timeout", 5*time.Second, "timeout of the probe")
+}
@@ -0,0 +1,119 @@
+/*
+Copyright © 2022 Dominik Ágh <agh.dominik@gmail.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/aghdom/current/data"
+)
+
+// outboxCmd represents the outbox command
+var outboxCmd = &cobra.Command{
+	Use:   "outbox",
+	Short: "Manages the federation outbox",
+	Long: `Posts are federated to Bluesky by jobs in the outbox, which are retried with
+a growing delay until they succeed. Jobs which keep failing are dead and are only
+attempted again when retried manually.`,
+}
+
+// outboxListCmd represents the outbox list command
+var outboxListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the federation jobs",
+	Long: `Lists the latest federation jobs with their state, attempts and last error.
+Use --state to only list the pending, done or dead jobs.`,
+	Args: cobra.NoArgs,
+	Run:  runOutboxList,
+}
+
+// outboxRetryCmd represents the outbox retry command
+var outboxRetryCmd = &cobra.Command{
+	Use:   "retry [id...]",
+	Short: "Retries federation jobs",
+	Long: `Schedules the given pending or dead jobs, or all the dead ones with --dead, to be attempted
+right away. A running server picks them up within a minute.`,
+	Run: runOutboxRetry,
+}
+
+func runOutboxList(cmd *cobra.Command, args []string) {
+	state, _ := cmd.Flags().GetString("state")
+	limit, _ := cmd.Flags().GetInt("limit")
+	switch data.OutboxState(state) {
+	case "", data.OutboxPending, data.OutboxDone, data.OutboxDead:
+	default:
+		cobra.CheckErr(fmt.Errorf("unknown state %q, expected pending, done or dead", state))
+	}
+	cobra.CheckErr(data.InitDB())
+
+	jobs, err := data.OutboxJobs(data.OutboxState(state), limit)
+	cobra.CheckErr(err)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tKIND\tPOST\tSTATE\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	for _, j := range jobs {
+		next := "-"
+		if j.State == data.OutboxPending {
+			next = j.NextAttempt.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%d\t%s\t%s\n", j.ID, j.Kind, j.Post.Unix(), j.State, j.Attempts, next, j.LastError)
+	}
+	w.Flush()
+}
+
+func runOutboxRetry(cmd *cobra.Command, args []string) {
+	dead, _ := cmd.Flags().GetBool("dead")
+	if dead == (len(args) > 0) {
+		cobra.CheckErr("expected either job IDs or --dead")
+	}
+	cobra.CheckErr(data.InitDB())
+
+	if dead {
+		n, err := data.RetryDeadOutboxJobs()
+		cobra.CheckErr(err)
+		fmt.Printf("Retrying %d dead jobs\n", n)
+		return
+	}
+	for _, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			cobra.CheckErr(fmt.Errorf("invalid job ID %q", arg))
+		}
+		if err := data.RetryOutboxJob(id); err != nil {
+			cobra.CheckErr(fmt.Errorf("job %d: %w", id, err))
+		}
+		fmt.Printf("Retrying job %d\n", id)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(outboxCmd)
+	outboxCmd.AddCommand(outboxListCmd, outboxRetryCmd)
+	outboxListCmd.Flags().String("state", "", "only list the jobs in this state (pending, done or dead)")
+	outboxListCmd.Flags().Int("limit", 50, "maximum number of jobs to list")
+	outboxRetryCmd.Flags().Bool("dead", false, "retry all the dead jobs")
+}
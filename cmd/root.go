@@ -22,11 +22,13 @@ THE SOFTWARE.
 package cmd
 
 import (
-	"fmt"
+	"log/slog"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/logging"
 )
 
 var cfgFile string
@@ -64,6 +66,15 @@ func init() {
 
 	// Persistent Flags
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.current.yaml)")
+	rootCmd.PersistentFlags().String("log_level", "info", "minimum level of logged records (debug, info, warn or error)")
+	rootCmd.PersistentFlags().String("log_format", "text", "format of log records (text or json)")
+
+	viper.SetDefault("log.output", "stderr")
+	viper.BindPFlag("log.level", rootCmd.PersistentFlags().Lookup("log_level"))
+	viper.BindPFlag("log.format", rootCmd.PersistentFlags().Lookup("log_format"))
+	viper.BindEnv("log.level", "CRNT_LOG_LEVEL")
+	viper.BindEnv("log.format", "CRNT_LOG_FORMAT")
+	viper.BindEnv("log.output", "CRNT_LOG_OUTPUT")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -89,7 +100,9 @@ func initConfig() {
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
-	if err := viper.ReadInConfig(); err == nil {
-		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
+	configErr := viper.ReadInConfig()
+	cobra.CheckErr(logging.Configure())
+	if configErr == nil {
+		slog.Info("Using config file", "path", viper.ConfigFileUsed())
 	}
 }
@@ -22,6 +22,8 @@ THE SOFTWARE.
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
@@ -39,7 +41,7 @@ The 'server' command starts serving the application on the specified host and po
 }
 
 func runServer(cmd *cobra.Command, args []string) {
-	server.Run()
+	cobra.CheckErr(server.Run())
 }
 
 func init() {
@@ -52,9 +54,57 @@ func init() {
 	serverCmd.Flags().String("bsky_handle", "", "BlueSky username for federation via API")
 	serverCmd.Flags().String("bsky_app_pass", "", "BlueSky app password for federation via API")
 	serverCmd.Flags().StringP("filepath", "f", "", "filepath for the SQLite DB file")
+	serverCmd.Flags().Bool("dev", false, "development mode, which reloads the theme from disk on changes")
+	serverCmd.Flags().String("dev_dir", "server", "directory with the default theme's sources, used in development mode")
+	serverCmd.Flags().String("theme", "", "directory with templates and static files overriding the default theme")
+	serverCmd.Flags().Duration("read_timeout", 10*time.Second, "maximum duration for reading an entire request")
+	serverCmd.Flags().Duration("write_timeout", 30*time.Second, "maximum duration before timing out writes of a response")
+	serverCmd.Flags().Duration("idle_timeout", 120*time.Second, "maximum duration to wait for the next request on keep-alive connections")
+	serverCmd.Flags().Int("max_header_bytes", 1<<16, "maximum size of request headers in bytes")
+	serverCmd.Flags().Duration("shutdown_timeout", 15*time.Second, "grace period for in-flight requests and background jobs on shutdown")
 
 	// Set defaults
 	viper.SetDefault("sqlite.filepath", "db/current.db")
+	viper.SetDefault("site.title", "current")
+	viper.SetDefault("site.description", "a personal micro-blog")
+	viper.SetDefault("site.base_url", "http://localhost:3773")
+	viper.SetDefault("site.logo", "bolt.svg")
+	viper.SetDefault("site.timezone", "UTC")
+	viper.SetDefault("feed.items", 20)
+	viper.SetDefault("robots.disallow", []string{"/author"})
+	viper.SetDefault("markdown.highlight.enabled", true)
+	viper.SetDefault("markdown.highlight.line_numbers", false)
+	viper.SetDefault("markdown.highlight.feed_style", "github")
+	viper.SetDefault("previews.enabled", true)
+	viper.SetDefault("previews.timeout", 5*time.Second)
+	viper.SetDefault("previews.max_bytes", 1<<20)
+	viper.SetDefault("metrics.enabled", true)
+	viper.SetDefault("health.min_free_bytes", 64<<20)
+	viper.SetDefault("ratelimit.enabled", true)
+	viper.SetDefault("ratelimit.public.rate", 10)
+	viper.SetDefault("ratelimit.public.burst", 40)
+	viper.SetDefault("ratelimit.search.rate", 0.2)
+	viper.SetDefault("ratelimit.search.burst", 5)
+	viper.SetDefault("ratelimit.admin.rate", 2)
+	viper.SetDefault("ratelimit.admin.burst", 10)
+	viper.SetDefault("ratelimit.login.max_failures", 5)
+	viper.SetDefault("ratelimit.login.lockout", time.Minute)
+	viper.SetDefault("ratelimit.login.max_lockout", time.Hour)
+	viper.SetDefault("events.enabled", true)
+	viper.SetDefault("events.max_clients", 15)
+	viper.SetDefault("events.heartbeat", 25*time.Second)
+	viper.SetDefault("events.history", 100)
+	viper.SetDefault("websub.timeout", 10*time.Second)
+	viper.SetDefault("websub.publish_timeout", 2*time.Minute)
+	viper.SetDefault("websub.hub.lease", 10*24*time.Hour)
+	viper.SetDefault("websub.hub.max_lease", 30*24*time.Hour)
+	viper.SetDefault("bsky.pds", "https://bsky.social")
+	viper.SetDefault("bsky.timeout", 15*time.Second)
+	viper.SetDefault("bsky.persist_session", false)
+	viper.SetDefault("outbox.max_attempts", 10)
+	viper.SetDefault("outbox.min_backoff", 30*time.Second)
+	viper.SetDefault("outbox.max_backoff", 6*time.Hour)
+	viper.SetDefault("outbox.retention", 30*24*time.Hour)
 
 	// Binding Flags to Viper
 	viper.BindPFlag("server.port", serverCmd.Flags().Lookup("port"))
@@ -64,6 +114,14 @@ func init() {
 	viper.BindPFlag("server.bsky_handle", serverCmd.Flags().Lookup("bsky_handle"))
 	viper.BindPFlag("server.bsky_app_pass", serverCmd.Flags().Lookup("bsky_app_pass"))
 	viper.BindPFlag("sqlite.filepath", serverCmd.Flags().Lookup("filepath"))
+	viper.BindPFlag("theme.dir", serverCmd.Flags().Lookup("theme"))
+	viper.BindPFlag("server.dev", serverCmd.Flags().Lookup("dev"))
+	viper.BindPFlag("server.dev_dir", serverCmd.Flags().Lookup("dev_dir"))
+	viper.BindPFlag("server.read_timeout", serverCmd.Flags().Lookup("read_timeout"))
+	viper.BindPFlag("server.write_timeout", serverCmd.Flags().Lookup("write_timeout"))
+	viper.BindPFlag("server.idle_timeout", serverCmd.Flags().Lookup("idle_timeout"))
+	viper.BindPFlag("server.max_header_bytes", serverCmd.Flags().Lookup("max_header_bytes"))
+	viper.BindPFlag("server.shutdown_timeout", serverCmd.Flags().Lookup("shutdown_timeout"))
 
 	// Binding Environment Variables to Viper
 	viper.BindEnv("server.port", "CRNT_SERVER_PORT")
@@ -73,5 +131,66 @@ func init() {
 	viper.BindEnv("server.bsky_handle", "CRNT_SERVER_BSKY_HANDLE")
 	viper.BindEnv("server.bsky_app_pass", "CRNT_SERVER_BSKY_APP_PASS")
 	viper.BindEnv("sqlite.filepath", "CRNT_SQLITE_FILEPATH")
+	viper.BindEnv("theme.dir", "CRNT_THEME_DIR")
+	viper.BindEnv("server.dev", "CRNT_SERVER_DEV")
+	viper.BindEnv("server.dev_dir", "CRNT_SERVER_DEV_DIR")
+	viper.BindEnv("server.read_timeout", "CRNT_SERVER_READ_TIMEOUT")
+	viper.BindEnv("server.write_timeout", "CRNT_SERVER_WRITE_TIMEOUT")
+	viper.BindEnv("server.idle_timeout", "CRNT_SERVER_IDLE_TIMEOUT")
+	viper.BindEnv("server.max_header_bytes", "CRNT_SERVER_MAX_HEADER_BYTES")
+	viper.BindEnv("server.shutdown_timeout", "CRNT_SERVER_SHUTDOWN_TIMEOUT")
+	viper.BindEnv("site.title", "CRNT_SITE_TITLE")
+	viper.BindEnv("site.description", "CRNT_SITE_DESCRIPTION")
+	viper.BindEnv("site.base_url", "CRNT_SITE_BASE_URL")
+	viper.BindEnv("site.author.name", "CRNT_SITE_AUTHOR_NAME")
+	viper.BindEnv("site.author.email", "CRNT_SITE_AUTHOR_EMAIL")
+	viper.BindEnv("site.author.url", "CRNT_SITE_AUTHOR_URL")
+	viper.BindEnv("site.logo", "CRNT_SITE_LOGO")
+	viper.BindEnv("site.about", "CRNT_SITE_ABOUT")
+	viper.BindEnv("site.timezone", "CRNT_SITE_TIMEZONE")
+	viper.BindEnv("feed.items", "CRNT_FEED_ITEMS")
+	viper.BindEnv("robots.file", "CRNT_ROBOTS_FILE")
+	viper.BindEnv("markdown.extensions", "CRNT_MARKDOWN_EXTENSIONS")
+	viper.BindEnv("markdown.highlight.enabled", "CRNT_MARKDOWN_HIGHLIGHT_ENABLED")
+	viper.BindEnv("markdown.highlight.line_numbers", "CRNT_MARKDOWN_HIGHLIGHT_LINE_NUMBERS")
+	viper.BindEnv("markdown.highlight.feed_style", "CRNT_MARKDOWN_HIGHLIGHT_FEED_STYLE")
+	viper.BindEnv("previews.enabled", "CRNT_PREVIEWS_ENABLED")
+	viper.BindEnv("previews.timeout", "CRNT_PREVIEWS_TIMEOUT")
+	viper.BindEnv("previews.max_bytes", "CRNT_PREVIEWS_MAX_BYTES")
+	viper.BindEnv("metrics.enabled", "CRNT_METRICS_ENABLED")
+	viper.BindEnv("metrics.token", "CRNT_METRICS_TOKEN")
+	viper.BindEnv("metrics.addr", "CRNT_METRICS_ADDR")
+	viper.BindEnv("health.min_free_bytes", "CRNT_HEALTH_MIN_FREE_BYTES")
+	viper.BindEnv("health.bsky", "CRNT_HEALTH_BSKY")
+	viper.BindEnv("health.max_federation_backlog", "CRNT_HEALTH_MAX_FEDERATION_BACKLOG")
+	viper.BindEnv("ratelimit.enabled", "CRNT_RATELIMIT_ENABLED")
+	viper.BindEnv("ratelimit.trusted_proxies", "CRNT_RATELIMIT_TRUSTED_PROXIES")
+	viper.BindEnv("ratelimit.public.rate", "CRNT_RATELIMIT_PUBLIC_RATE")
+	viper.BindEnv("ratelimit.public.burst", "CRNT_RATELIMIT_PUBLIC_BURST")
+	viper.BindEnv("ratelimit.search.rate", "CRNT_RATELIMIT_SEARCH_RATE")
+	viper.BindEnv("ratelimit.search.burst", "CRNT_RATELIMIT_SEARCH_BURST")
+	viper.BindEnv("ratelimit.admin.rate", "CRNT_RATELIMIT_ADMIN_RATE")
+	viper.BindEnv("ratelimit.admin.burst", "CRNT_RATELIMIT_ADMIN_BURST")
+	viper.BindEnv("ratelimit.login.max_failures", "CRNT_RATELIMIT_LOGIN_MAX_FAILURES")
+	viper.BindEnv("ratelimit.login.lockout", "CRNT_RATELIMIT_LOGIN_LOCKOUT")
+	viper.BindEnv("ratelimit.login.max_lockout", "CRNT_RATELIMIT_LOGIN_MAX_LOCKOUT")
+	viper.BindEnv("events.enabled", "CRNT_EVENTS_ENABLED")
+	viper.BindEnv("events.max_clients", "CRNT_EVENTS_MAX_CLIENTS")
+	viper.BindEnv("events.heartbeat", "CRNT_EVENTS_HEARTBEAT")
+	viper.BindEnv("events.history", "CRNT_EVENTS_HISTORY")
+	viper.BindEnv("websub.hubs", "CRNT_WEBSUB_HUBS")
+	viper.BindEnv("websub.timeout", "CRNT_WEBSUB_TIMEOUT")
+	viper.BindEnv("websub.publish_timeout", "CRNT_WEBSUB_PUBLISH_TIMEOUT")
+	viper.BindEnv("websub.hub.enabled", "CRNT_WEBSUB_HUB_ENABLED")
+	viper.BindEnv("websub.hub.lease", "CRNT_WEBSUB_HUB_LEASE")
+	viper.BindEnv("websub.hub.max_lease", "CRNT_WEBSUB_HUB_MAX_LEASE")
+	viper.BindEnv("websub.hub.allow_private", "CRNT_WEBSUB_HUB_ALLOW_PRIVATE")
+	viper.BindEnv("bsky.pds", "CRNT_BSKY_PDS")
+	viper.BindEnv("bsky.timeout", "CRNT_BSKY_TIMEOUT")
+	viper.BindEnv("bsky.persist_session", "CRNT_BSKY_PERSIST_SESSION")
+	viper.BindEnv("outbox.max_attempts", "CRNT_OUTBOX_MAX_ATTEMPTS")
+	viper.BindEnv("outbox.min_backoff", "CRNT_OUTBOX_MIN_BACKOFF")
+	viper.BindEnv("outbox.max_backoff", "CRNT_OUTBOX_MAX_BACKOFF")
+	viper.BindEnv("outbox.retention", "CRNT_OUTBOX_RETENTION")
 
 }
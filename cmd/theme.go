@@ -0,0 +1,62 @@
+/*
+Copyright © 2022 Dominik Ágh <agh.dominik@gmail.com>
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/aghdom/current/server"
+)
+
+// themeCmd represents the theme command
+var themeCmd = &cobra.Command{
+	Use:   "theme",
+	Short: "Manages the site's theme",
+	Long: `The theme consists of the HTML templates and static files of the site.
+The defaults are compiled into the binary, but individual files can be overridden
+by placing them in a theme directory, configured via 'theme.dir'.`,
+}
+
+// themeExportCmd represents the theme export command
+var themeExportCmd = &cobra.Command{
+	Use:   "export [directory]",
+	Short: "Exports the default theme for customisation",
+	Long: `Copies the default templates and static files into the given directory (default "theme").
+Files which are left unchanged can be deleted afterwards, as the defaults are used in their place.`,
+	Args: cobra.MaximumNArgs(1),
+	Run:  runThemeExport,
+}
+
+func runThemeExport(cmd *cobra.Command, args []string) {
+	dir := "theme"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+	force, _ := cmd.Flags().GetBool("force")
+	cobra.CheckErr(server.ExportTheme(dir, force, cmd.OutOrStdout()))
+}
+
+func init() {
+	rootCmd.AddCommand(themeCmd)
+	themeCmd.AddCommand(themeExportCmd)
+	themeExportCmd.Flags().Bool("force", false, "overwrite existing files")
+}
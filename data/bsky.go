@@ -2,50 +2,20 @@ package data
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"log"
-	"net/http"
+	"log/slog"
+	"net/url"
 	"regexp"
 	"strings"
 	"time"
 
 	"github.com/spf13/viper"
-)
 
-const (
-	BSKY_XRPC_URI = "https://bsky.social/xrpc/"
+	"github.com/aghdom/current/logging"
 )
 
-type sessionResult struct {
-	DID          string `json:"did"`
-	AccessToken  string `json:"accessJwt"`
-	RefreshToken string `json:"refreshJwt"`
-}
-
-func createSession() (sessionResult, error) {
-	bskyHandle := viper.GetString("server.bsky_handle")
-	appPass := viper.GetString("server.bsky_app_pass")
-
-	payload := fmt.Sprintf("{\"identifier\": \"%s\", \"password\": \"%s\"}", bskyHandle, appPass)
-	pldReader := bytes.NewReader([]byte(payload))
-
-	res, err := http.Post(BSKY_XRPC_URI+"com.atproto.server.createSession", "application/json", pldReader)
-	if err != nil {
-		log.Printf("Failed to create BlueSky session: %s", err.Error())
-		return sessionResult{}, err
-	}
-	defer res.Body.Close()
-
-	sRes := sessionResult{}
-	if derr := json.NewDecoder(res.Body).Decode(&sRes); derr != nil {
-		log.Printf("Failed to decode BlueSky session response: %s", derr.Error())
-		return sessionResult{}, err
-	}
-
-	return sRes, nil
-}
-
 type bskyFacetIndex struct {
 	ByteStart int `json:"byteStart"`
 	ByteEnd   int `json:"byteEnd"`
@@ -68,8 +38,28 @@ type bskyPost struct {
 	Text      string      `json:"text"`
 	CreatedAt string      `json:"createdAt"`
 	Facets    []bskyFacet `json:"facets,omitempty"`
+	Embed     *bskyEmbed  `json:"embed,omitempty"`
 }
 
+type bskyExternal struct {
+	URI         string          `json:"uri"`
+	Title       string          `json:"title"`
+	Description string          `json:"description"`
+	Thumb       json.RawMessage `json:"thumb,omitempty"`
+}
+
+type bskyEmbed struct {
+	Type     string       `json:"$type"`
+	External bskyExternal `json:"external"`
+}
+
+type bskyUploadBlobResp struct {
+	Blob json.RawMessage `json:"blob"`
+}
+
+// bskyMaxThumbBytes is the size limit of images uploaded as the thumbnail of an external embed.
+const bskyMaxThumbBytes = 1000000
+
 type bskyCreatePostPld struct {
 	Repo       string   `json:"repo"`
 	Collection string   `json:"collection"`
@@ -101,27 +91,26 @@ func trimEmphasis(content string) string {
 	return string(result)
 }
 
-func bskyResolveHandle(handle string) string {
-	res, err := http.Get(BSKY_XRPC_URI + "com.atproto.identity.resolveHandle?handle=" + handle)
-	if err != nil || res.StatusCode == http.StatusBadRequest {
-		//If we fail to resolve, just continue
-		return ""
+// resolveHandle returns the DID of 'handle', or "" if it can't be resolved.
+func (c *BskyClient) resolveHandle(ctx context.Context, handle string) string {
+	var res struct {
+		DID string `json:"did"`
 	}
-	defer res.Body.Close()
-	var data map[string]string
-	if err = json.NewDecoder(res.Body).Decode(&data); err != nil {
+	if err := c.call(ctx, "com.atproto.identity.resolveHandle", "", url.Values{"handle": {handle}}, nil, "", &res); err != nil {
+		//If we fail to resolve, just continue
+		slog.Debug("Failed to resolve BlueSky handle", "handle", handle, logging.Err(err))
 		return ""
 	}
-	return data["did"]
+	return res.DID
 }
 
-func parseMentions(content string) []bskyFacet {
+func parseMentions(content string, resolve func(handle string) string) []bskyFacet {
 	var mentions []bskyFacet
 	mre := regexp.MustCompile(`[$|\W](@([a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)`)
 	locs := mre.FindAllSubmatchIndex([]byte(content), -1)
 	for _, loc := range locs {
 		handle := string(content[loc[2]+1 : loc[3]]) // +1 to skip the initial @ symbol
-		did := bskyResolveHandle(handle)
+		did := resolve(handle)
 		if did == "" {
 			// We failed to parse handle, skip this mention, it will be shown as plain text
 			continue
@@ -170,19 +159,19 @@ func parseLinks(content string) (string, []bskyFacet) {
 	return content, links
 }
 
-func parseFacets(content string) (string, []bskyFacet) {
+func parseFacets(content string, resolve func(handle string) string) (string, []bskyFacet) {
 	var facets []bskyFacet
 	//Links must be parsed first, as they change the content
 	content, links := parseLinks(content)
 	facets = append(facets, links...)
-	facets = append(facets, parseMentions(content)...)
+	facets = append(facets, parseMentions(content, resolve)...)
 
 	return content, facets
 }
 
-func convertToBskyPost(content string, created time.Time) bskyPost {
+func convertToBskyPost(content string, created time.Time, resolve func(handle string) string) bskyPost {
 	content = trimEmphasis(content)
-	content, facets := parseFacets(content)
+	content, facets := parseFacets(content, resolve)
 	p := bskyPost{
 		Type:      "app.bsky.feed.post",
 		Text:      content,
@@ -192,63 +181,93 @@ func convertToBskyPost(content string, created time.Time) bskyPost {
 	return p
 }
 
-func BskyCreatePost(content string, created time.Time) (string, error) {
-	session, err := createSession()
-	if err != nil {
-		return "", err
+// uploadThumb uploads the image at 'imageURL' as a blob, to be referenced by an embed.
+// If anything fails, nil is returned, and the embed is posted without a thumbnail.
+func (c *BskyClient) uploadThumb(ctx context.Context, imageURL string) json.RawMessage {
+	fetchCtx, cancel := context.WithTimeout(ctx, viper.GetDuration("previews.timeout"))
+	defer cancel()
+	img, contentType, err := fetchLimited(fetchCtx, imageURL, bskyMaxThumbBytes+1)
+	if err != nil || len(img) > bskyMaxThumbBytes || !strings.HasPrefix(contentType, "image/") {
+		return nil
 	}
 
-	pld := bskyCreatePostPld{
-		Repo:       session.DID,
-		Collection: "app.bsky.feed.post",
-		Record:     convertToBskyPost(content, created),
-	}
-	pldJson, err := json.Marshal(pld)
-	if err != nil {
-		log.Printf("Failed to encode BlueSky create post payload: %s", err.Error())
-		return "", err
+	ubRes := bskyUploadBlobResp{}
+	if _, err := c.authCall(ctx, "com.atproto.repo.uploadBlob", nil, bytes.NewReader(img), contentType, &ubRes); err != nil {
+		slog.Error("Failed to upload BlueSky blob", logging.Err(err))
+		return nil
 	}
-	log.Println(string(pldJson))
-	pldReader := bytes.NewReader(pldJson)
+	return ubRes.Blob
+}
 
-	r, err := http.NewRequest(http.MethodPost, BSKY_XRPC_URI+"com.atproto.repo.createRecord", pldReader)
-	if err != nil {
-		log.Printf("Failed to create BlueSky post request: %s", err.Error())
-		return "", err
+// externalEmbed turns a link preview into an external embed, i.e. the link card shown under the post.
+func (c *BskyClient) externalEmbed(ctx context.Context, preview *LinkPreview) *bskyEmbed {
+	e := &bskyEmbed{
+		Type: "app.bsky.embed.external",
+		External: bskyExternal{
+			URI:         preview.URL,
+			Title:       preview.Title,
+			Description: preview.Description,
+		},
 	}
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", "Bearer "+session.AccessToken)
+	if preview.Image != "" {
+		e.External.Thumb = c.uploadThumb(ctx, preview.Image)
+	}
+	return e
+}
 
-	client := &http.Client{}
-	res, err := client.Do(r)
+// CreatePost posts 'content' to Bluesky, with 'preview' as its link card, if not nil, and returns the AT URI of the post.
+func (c *BskyClient) CreatePost(ctx context.Context, content string, created time.Time, preview *LinkPreview) (string, error) {
+	// The session is needed for the DID of the repo anyway, so it's created before resolving the mentions
+	session, err := c.authenticate(ctx, false)
 	if err != nil {
-		log.Printf("Failed to create BlueSky post: %s", err.Error())
 		return "", err
 	}
-	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusOK {
-		log.Printf("Failed to create BlueSky post, status code: %d", res.StatusCode)
-		return "", err
+	record := convertToBskyPost(content, created, func(handle string) string { return c.resolveHandle(ctx, handle) })
+	if preview != nil {
+		record.Embed = c.externalEmbed(ctx, preview)
 	}
+	pld := bskyCreatePostPld{
+		Repo:       session.DID,
+		Collection: "app.bsky.feed.post",
+		Record:     record,
+	}
+	slog.Debug("Creating BlueSky post", logging.Post(created))
 
 	cpRes := bskyCreatePostResp{}
-	if derr := json.NewDecoder(res.Body).Decode(&cpRes); derr != nil {
-		log.Printf("Failed to decode BlueSky create post response: %s", derr.Error())
+	if _, err := c.authCall(ctx, "com.atproto.repo.createRecord", nil, pld, "", &cpRes); err != nil {
+		slog.Error("Failed to create BlueSky post", logging.Post(created), logging.Err(err))
+		return "", err
+	}
+	if cpRes.URI == "" {
+		err := fmt.Errorf("com.atproto.repo.createRecord: response without a URI")
+		slog.Error("Failed to create BlueSky post", logging.Post(created), logging.Err(err))
 		return "", err
 	}
 
+	slog.Info("Federated post", logging.Post(created), logging.BskyURI(cpRes.URI))
 	return cpRes.URI, nil
 }
 
+// BskyPostURL returns the web URL of the Bluesky post with the AT URI 'uri', e.g.
+// "at://did:plc:xyz/app.bsky.feed.post/3k2a" becomes "https://bsky.app/profile/did:plc:xyz/post/3k2a".
+func BskyPostURL(uri string) string {
+	parts := strings.Split(strings.TrimPrefix(uri, "at://"), "/")
+	if len(parts) != 3 || parts[1] != "app.bsky.feed.post" {
+		return ""
+	}
+	return "https://bsky.app/profile/" + parts[0] + "/post/" + parts[2]
+}
+
 type bskyDeletePostPld struct {
 	Repo       string `json:"repo"`
 	Collection string `json:"collection"`
 	RecordKey  string `json:"rkey"`
 }
 
-func BskyDeletePost(uri string) error {
-	session, err := createSession()
+// DeletePost deletes the Bluesky post with the AT URI 'uri'.
+func (c *BskyClient) DeletePost(ctx context.Context, uri string) error {
+	session, err := c.authenticate(ctx, false)
 	if err != nil {
 		return err
 	}
@@ -261,33 +280,9 @@ func BskyDeletePost(uri string) error {
 		Collection: "app.bsky.feed.post",
 		RecordKey:  rKey,
 	}
-	pldJson, err := json.Marshal(pld)
-	if err != nil {
-		log.Printf("Failed to encode BlueSky delete post payload: %s", err.Error())
-		return err
-	}
-	pldReader := bytes.NewReader(pldJson)
-
-	r, err := http.NewRequest(http.MethodPost, BSKY_XRPC_URI+"com.atproto.repo.deleteRecord", pldReader)
-	if err != nil {
-		log.Printf("Failed to delete BlueSky post request: %s", err.Error())
-		return err
-	}
-	r.Header.Add("Content-Type", "application/json")
-	r.Header.Add("Authorization", "Bearer "+session.AccessToken)
-
-	client := &http.Client{}
-	res, err := client.Do(r)
-	if err != nil {
-		log.Printf("Failed to delete BlueSky post: %s", err.Error())
+	if _, err := c.authCall(ctx, "com.atproto.repo.deleteRecord", nil, pld, "", nil); err != nil {
+		slog.Error("Failed to delete BlueSky post", logging.Err(err), logging.BskyURI(uri))
 		return err
 	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		log.Printf("Failed to delete BlueSky post, status code: %d", res.StatusCode)
-		return fmt.Errorf("deleteRecord request failed with status code %d", res.StatusCode)
-	}
-
 	return nil
 }
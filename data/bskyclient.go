@@ -0,0 +1,334 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/logging"
+)
+
+// BskyConfig configures the client of the Bluesky PDS (Personal Data Server) hosting the account.
+type BskyConfig struct {
+	// PDS is the base URL of the PDS, e.g. "https://bsky.social"
+	PDS         string
+	Handle      string
+	AppPassword string
+	// Timeout bounds every single XRPC call
+	Timeout time.Duration
+	// PersistSession stores the session in the DB, so it survives restarts
+	PersistSession bool
+}
+
+// loadBskyConfig reads the Bluesky client configuration from viper.
+func loadBskyConfig() BskyConfig {
+	return BskyConfig{
+		PDS:            viper.GetString("bsky.pds"),
+		Handle:         viper.GetString("server.bsky_handle"),
+		AppPassword:    viper.GetString("server.bsky_app_pass"),
+		Timeout:        viper.GetDuration("bsky.timeout"),
+		PersistSession: viper.GetBool("bsky.persist_session"),
+	}
+}
+
+// XRPCError is the error response of an XRPC method.
+type XRPCError struct {
+	Method string `json:"-"`
+	Status int    `json:"-"`
+	// Name identifies the error, e.g. "ExpiredToken" or "RateLimitExceeded"
+	Name    string `json:"error"`
+	Message string `json:"message"`
+	// RetryAfter is the time until a rate limited method may be called again, if known
+	RetryAfter time.Duration `json:"-"`
+}
+
+func (e *XRPCError) Error() string {
+	msg := fmt.Sprintf("%s: status code %d", e.Method, e.Status)
+	if e.Name != "" {
+		msg += ": " + e.Name
+	}
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+// Names of the XRPC errors handled by the client.
+const (
+	xrpcExpiredToken      = "ExpiredToken"
+	xrpcInvalidToken      = "InvalidToken"
+	xrpcRateLimitExceeded = "RateLimitExceeded"
+)
+
+// IsXRPCError reports whether 'err' is an XRPC error response named 'name'.
+func IsXRPCError(err error, name string) bool {
+	var xe *XRPCError
+	return errors.As(err, &xe) && xe.Name == name
+}
+
+// decodeXRPCError builds the error of a non-2xx response to 'method'.
+func decodeXRPCError(method string, res *http.Response) error {
+	xe := &XRPCError{Method: method, Status: res.StatusCode}
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+	// The body isn't guaranteed to be JSON, e.g. from a proxy in front of the PDS
+	_ = json.Unmarshal(body, xe)
+	if xe.Name == "" && res.StatusCode == http.StatusTooManyRequests {
+		xe.Name = xrpcRateLimitExceeded
+	}
+	if secs, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		xe.RetryAfter = time.Duration(secs) * time.Second
+	} else if reset, err := strconv.ParseInt(res.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		xe.RetryAfter = max(time.Until(time.Unix(reset, 0)), 0)
+	}
+	return xe
+}
+
+// bskySessionTokens are the credentials of an authenticated session.
+type bskySessionTokens struct {
+	DID          string `json:"did"`
+	Handle       string `json:"handle"`
+	AccessToken  string `json:"accessJwt"`
+	RefreshToken string `json:"refreshJwt"`
+}
+
+// BskyClient calls the XRPC methods of a PDS. It reuses the session across calls, refreshes its access token
+// once it expires and only logs in again with the app password, if the refresh token has expired as well.
+type BskyClient struct {
+	cfg  BskyConfig
+	http *http.Client
+
+	// mu guards the session, which is nil until the first authenticated call
+	mu      sync.Mutex
+	session *bskySessionTokens
+}
+
+// NewBskyClient returns a client of the PDS in 'cfg'.
+func NewBskyClient(cfg BskyConfig) *BskyClient {
+	if cfg.PDS == "" {
+		cfg.PDS = "https://bsky.social"
+	}
+	cfg.PDS = strings.TrimSuffix(cfg.PDS, "/")
+	return &BskyClient{cfg: cfg, http: newBskyHTTP(cfg.Timeout)}
+}
+
+var defaultBsky = struct {
+	sync.Once
+	client *BskyClient
+}{}
+
+// bskyClient returns the client shared by the application, configured from viper on first use.
+func bskyClient() *BskyClient {
+	defaultBsky.Do(func() {
+		defaultBsky.client = NewBskyClient(loadBskyConfig())
+	})
+	return defaultBsky.client
+}
+
+// call calls the XRPC 'method' and decodes its response into 'out', unless it's nil. Procedures are called
+// with 'in' as their body, which is either an io.Reader of 'contentType' or a value encoded as JSON.
+// Queries (in == nil) are called with 'query' as the parameters. 'token' authorises the call, if not empty.
+func (c *BskyClient) call(ctx context.Context, method, token string, query url.Values, in any, contentType string, out any) error {
+	target := c.cfg.PDS + "/xrpc/" + method
+	httpMethod := http.MethodGet
+	var body io.Reader
+	switch v := in.(type) {
+	case nil:
+		if len(query) > 0 {
+			target += "?" + query.Encode()
+		}
+	case io.Reader:
+		httpMethod, body = http.MethodPost, v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("encoding %s payload: %w", method, err)
+		}
+		httpMethod, body, contentType = http.MethodPost, bytes.NewReader(b), "application/json"
+	}
+	req, err := http.NewRequestWithContext(ctx, httpMethod, target, body)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return decodeXRPCError(method, res)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("decoding %s response: %w", method, err)
+	}
+	return nil
+}
+
+// createSession logs in with the app password.
+func (c *BskyClient) createSession(ctx context.Context) (*bskySessionTokens, error) {
+	var s bskySessionTokens
+	err := c.call(ctx, "com.atproto.server.createSession", "", nil,
+		map[string]string{"identifier": c.cfg.Handle, "password": c.cfg.AppPassword}, "", &s)
+	recordBskySession(err)
+	if err != nil {
+		slog.Error("Failed to create BlueSky session", logging.Err(err))
+		return nil, err
+	}
+	slog.Info("Created BlueSky session", "did", s.DID)
+	return &s, nil
+}
+
+// refreshSession exchanges the refresh token of 's' for new tokens.
+func (c *BskyClient) refreshSession(ctx context.Context, s *bskySessionTokens) (*bskySessionTokens, error) {
+	var fresh bskySessionTokens
+	err := c.call(ctx, "com.atproto.server.refreshSession", s.RefreshToken, nil, bytes.NewReader(nil), "", &fresh)
+	if err != nil {
+		return nil, err
+	}
+	slog.Debug("Refreshed BlueSky session", "did", fresh.DID)
+	return &fresh, nil
+}
+
+// jwtExpiry returns the expiry of the JWT 'token', read without verifying it. It is zero, if the token has none.
+func jwtExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return time.Time{}
+	}
+	var claims struct {
+		Exp int64 `json:"exp"`
+	}
+	if json.Unmarshal(payload, &claims) != nil || claims.Exp == 0 {
+		return time.Time{}
+	}
+	return time.Unix(claims.Exp, 0)
+}
+
+// tokenExpired reports whether 'token' has expired, or is about to.
+func tokenExpired(token string) bool {
+	exp := jwtExpiry(token)
+	return !exp.IsZero() && time.Until(exp) < time.Minute
+}
+
+// authenticate returns a session with a usable access token. It is reused from memory or the DB,
+// refreshed if its access token expired and only created anew, if that's not possible.
+// With 'stale' set, the current access token was rejected and must not be reused.
+func (c *BskyClient) authenticate(ctx context.Context, stale bool) (*bskySessionTokens, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.session == nil && c.cfg.PersistSession {
+		s, err := loadBskySession(c.cfg.Handle)
+		if err != nil {
+			slog.Warn("Failed to load the stored BlueSky session", logging.Err(err))
+		}
+		c.session = s
+	}
+	s := c.session
+	if s != nil && !stale && !tokenExpired(s.AccessToken) {
+		return s, nil
+	}
+
+	var err error
+	if s != nil && !tokenExpired(s.RefreshToken) {
+		if s, err = c.refreshSession(ctx, s); err != nil {
+			slog.Warn("Failed to refresh BlueSky session", logging.Err(err))
+		}
+	} else {
+		s = nil
+	}
+	if s == nil {
+		if s, err = c.createSession(ctx); err != nil {
+			c.session = nil
+			return nil, err
+		}
+	}
+	c.session = s
+	if c.cfg.PersistSession {
+		if err := storeBskySession(c.cfg.Handle, s); err != nil {
+			slog.Warn("Failed to store the BlueSky session", logging.Err(err))
+		}
+	}
+	return s, nil
+}
+
+// authCall is call, authorised by the session. If the access token turns out to be expired or revoked,
+// the session is refreshed and the call retried once. Bodies passed as an io.Reader must be *bytes.Reader,
+// so they can be sent again.
+func (c *BskyClient) authCall(ctx context.Context, method string, query url.Values, in any, contentType string, out any) (*bskySessionTokens, error) {
+	s, err := c.authenticate(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	err = c.call(ctx, method, s.AccessToken, query, in, contentType, out)
+	if !IsXRPCError(err, xrpcExpiredToken) && !IsXRPCError(err, xrpcInvalidToken) {
+		return s, err
+	}
+	if s, err = c.authenticate(ctx, true); err != nil {
+		return nil, err
+	}
+	if r, ok := in.(*bytes.Reader); ok {
+		r.Seek(0, io.SeekStart)
+	}
+	return s, c.call(ctx, method, s.AccessToken, query, in, contentType, out)
+}
+
+// loadBskySession returns the session stored for 'handle', or nil if there is none.
+func loadBskySession(handle string) (*bskySessionTokens, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var s bskySessionTokens
+	err = db.QueryRow("SELECT did, handle, access_jwt, refresh_jwt FROM bsky_session WHERE handle = ?", handle).
+		Scan(&s.DID, &s.Handle, &s.AccessToken, &s.RefreshToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// storeBskySession replaces the stored session with 's', created by logging in as 'handle'.
+func storeBskySession(handle string, s *bskySessionTokens) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT OR REPLACE INTO bsky_session(id, did, handle, access_jwt, refresh_jwt, updated) VALUES (1, ?, ?, ?, ?, ?)",
+		s.DID, handle, s.AccessToken, s.RefreshToken, time.Now().Unix())
+	return err
+}
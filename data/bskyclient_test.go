@@ -0,0 +1,277 @@
+package data
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testJWT returns an unsigned JWT expiring at 'exp', tagged with 'id' to tell the tokens apart.
+func testJWT(exp time.Time, id string) string {
+	payload, _ := json.Marshal(map[string]any{"exp": exp.Unix(), "jti": id})
+	return "e30." + base64.RawURLEncoding.EncodeToString(payload) + ".sig"
+}
+
+// fakePDS is a local XRPC server, which records the calls it receives.
+type fakePDS struct {
+	*httptest.Server
+
+	mu    sync.Mutex
+	calls map[string]int
+	// auth holds the Authorization header of every call, by method
+	auth map[string][]string
+	// sessionTTL is the lifetime of the access tokens of new sessions, refreshed ones last an hour
+	sessionTTL time.Duration
+	// reject answers the calls to a method with an error, while it returns true
+	reject func(method string, n int) bool
+	issued int
+	// tokens holds the issued tokens by their IDs, e.g. "access1" and "refresh1" for the first session
+	tokens map[string]string
+}
+
+func newFakePDS(t *testing.T) *fakePDS {
+	p := &fakePDS{calls: map[string]int{}, auth: map[string][]string{}, tokens: map[string]string{}, sessionTTL: time.Hour}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakePDS) serve(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/xrpc/")
+	p.mu.Lock()
+	p.calls[method]++
+	n := p.calls[method]
+	p.auth[method] = append(p.auth[method], r.Header.Get("Authorization"))
+	reject := p.reject != nil && p.reject(method, n)
+	var session map[string]string
+	if method == "com.atproto.server.createSession" || method == "com.atproto.server.refreshSession" {
+		p.issued++
+		access, refresh := fmt.Sprintf("access%d", p.issued), fmt.Sprintf("refresh%d", p.issued)
+		ttl := time.Hour
+		if method == "com.atproto.server.createSession" {
+			ttl = p.sessionTTL
+		}
+		p.tokens[access] = testJWT(time.Now().Add(ttl), access)
+		p.tokens[refresh] = testJWT(time.Now().Add(24*time.Hour), refresh)
+		session = map[string]string{"did": "did:plc:test", "handle": "test.example", "accessJwt": p.tokens[access], "refreshJwt": p.tokens[refresh]}
+	}
+	p.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	switch {
+	case reject:
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error":"ExpiredToken","message":"Token has expired"}`)
+	case session != nil:
+		json.NewEncoder(w).Encode(session)
+	default:
+		fmt.Fprint(w, `{}`)
+	}
+}
+
+func (p *fakePDS) count(method string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls[method]
+}
+
+func (p *fakePDS) authorizations(method string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.auth[method]...)
+}
+
+// bearer returns the Authorization header of the token issued as 'id'.
+func (p *fakePDS) bearer(id string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return "Bearer " + p.tokens[id]
+}
+
+func (p *fakePDS) client() *BskyClient {
+	return NewBskyClient(BskyConfig{PDS: p.URL + "/", Handle: "test.example", AppPassword: "secret", Timeout: 5 * time.Second})
+}
+
+const deleteRecord = "com.atproto.repo.deleteRecord"
+
+func TestBskyClientReusesSession(t *testing.T) {
+	pds := newFakePDS(t)
+	c := pds.client()
+	for i := 0; i < 3; i++ {
+		if err := c.DeletePost(context.Background(), "at://did:plc:test/app.bsky.feed.post/abc"); err != nil {
+			t.Fatalf("DeletePost #%d: %v", i+1, err)
+		}
+	}
+	if n := pds.count("com.atproto.server.createSession"); n != 1 {
+		t.Errorf("created %d sessions, want 1", n)
+	}
+	if n := pds.count("com.atproto.server.refreshSession"); n != 0 {
+		t.Errorf("refreshed the session %d times, want 0", n)
+	}
+	for i, auth := range pds.authorizations(deleteRecord) {
+		if auth != pds.bearer("access1") {
+			t.Errorf("call #%d was authorised with %q, want the first access token", i+1, auth)
+		}
+	}
+}
+
+func TestBskyClientRefreshesExpiringToken(t *testing.T) {
+	pds := newFakePDS(t)
+	// The access token expires within the minute, in which it's considered expired already
+	pds.sessionTTL = 30 * time.Second
+	c := pds.client()
+	for i := 0; i < 2; i++ {
+		if err := c.DeletePost(context.Background(), "at://did:plc:test/app.bsky.feed.post/abc"); err != nil {
+			t.Fatalf("DeletePost #%d: %v", i+1, err)
+		}
+	}
+	if n := pds.count("com.atproto.server.createSession"); n != 1 {
+		t.Errorf("created %d sessions, want 1", n)
+	}
+	if n := pds.count("com.atproto.server.refreshSession"); n != 1 {
+		t.Fatalf("refreshed the session %d times, want 1", n)
+	}
+	// The refresh is authorised with the refresh token, the calls with the refreshed access token
+	if auth := pds.authorizations("com.atproto.server.refreshSession")[0]; auth != pds.bearer("refresh1") {
+		t.Errorf("refresh was authorised with %q, want the first refresh token", auth)
+	}
+	for i, auth := range pds.authorizations(deleteRecord) {
+		if auth != pds.bearer("access2") {
+			t.Errorf("call #%d was authorised with %q, want the refreshed access token", i+1, auth)
+		}
+	}
+}
+
+func TestBskyClientRetriesExpiredTokenOnce(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		rejects int
+		wantErr bool
+		want    int
+	}{
+		{name: "succeeds after refresh", rejects: 1, want: 2},
+		{name: "gives up after one retry", rejects: 10, wantErr: true, want: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			pds := newFakePDS(t)
+			pds.reject = func(method string, n int) bool { return method == deleteRecord && n <= tc.rejects }
+			c := pds.client()
+
+			err := c.DeletePost(context.Background(), "at://did:plc:test/app.bsky.feed.post/abc")
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("DeletePost: %v, want error: %t", err, tc.wantErr)
+			}
+			if tc.wantErr && !IsXRPCError(err, xrpcExpiredToken) {
+				t.Errorf("DeletePost: %v, want %s", err, xrpcExpiredToken)
+			}
+			if n := pds.count(deleteRecord); n != tc.want {
+				t.Errorf("called %s %d times, want %d", deleteRecord, n, tc.want)
+			}
+			if n := pds.count("com.atproto.server.refreshSession"); n != 1 {
+				t.Errorf("refreshed the session %d times, want 1", n)
+			}
+			if auth := pds.authorizations(deleteRecord); auth[0] != pds.bearer("access1") || auth[1] != pds.bearer("access2") {
+				t.Errorf("calls were authorised with %q, want the first access token, then the refreshed one", auth)
+			}
+		})
+	}
+}
+
+func TestDecodeXRPCError(t *testing.T) {
+	reset := time.Now().Add(90 * time.Second)
+	for _, tc := range []struct {
+		name    string
+		status  int
+		header  map[string]string
+		body    string
+		want    XRPCError
+		wantMsg string
+		// retryAfter is compared within a few seconds, for the ones derived from the clock
+		retryAfter time.Duration
+	}{
+		{
+			name:    "JSON body",
+			status:  http.StatusBadRequest,
+			body:    `{"error":"InvalidRequest","message":"Invalid record"}`,
+			want:    XRPCError{Name: "InvalidRequest", Message: "Invalid record"},
+			wantMsg: "app.test: status code 400: InvalidRequest: Invalid record",
+		},
+		{
+			name:    "non-JSON body",
+			status:  http.StatusBadGateway,
+			body:    "<html>Bad Gateway</html>",
+			wantMsg: "app.test: status code 502",
+		},
+		{
+			name:       "Retry-After",
+			status:     http.StatusTooManyRequests,
+			header:     map[string]string{"Retry-After": "30"},
+			want:       XRPCError{Name: xrpcRateLimitExceeded},
+			retryAfter: 30 * time.Second,
+		},
+		{
+			name:       "RateLimit-Reset",
+			status:     http.StatusTooManyRequests,
+			header:     map[string]string{"RateLimit-Reset": fmt.Sprint(reset.Unix())},
+			body:       `{"error":"RateLimitExceeded","message":"Rate Limit Exceeded"}`,
+			want:       XRPCError{Name: xrpcRateLimitExceeded, Message: "Rate Limit Exceeded"},
+			retryAfter: time.Until(reset),
+		},
+		{
+			name:   "RateLimit-Reset in the past",
+			status: http.StatusTooManyRequests,
+			header: map[string]string{"RateLimit-Reset": fmt.Sprint(time.Now().Add(-time.Minute).Unix())},
+			want:   XRPCError{Name: xrpcRateLimitExceeded},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			for k, v := range tc.header {
+				rec.Header().Set(k, v)
+			}
+			rec.WriteHeader(tc.status)
+			rec.WriteString(tc.body)
+
+			err := decodeXRPCError("app.test", rec.Result())
+			var xe *XRPCError
+			if !errors.As(err, &xe) {
+				t.Fatalf("decodeXRPCError returned %T, want *XRPCError", err)
+			}
+			if xe.Method != "app.test" || xe.Status != tc.status || xe.Name != tc.want.Name || xe.Message != tc.want.Message {
+				t.Errorf("decodeXRPCError = %+v, want %+v with method app.test and status %d", *xe, tc.want, tc.status)
+			}
+			if d := xe.RetryAfter - tc.retryAfter; d < -2*time.Second || d > 2*time.Second {
+				t.Errorf("RetryAfter = %v, want %v", xe.RetryAfter, tc.retryAfter)
+			}
+			if tc.wantMsg != "" && err.Error() != tc.wantMsg {
+				t.Errorf("Error() = %q, want %q", err.Error(), tc.wantMsg)
+			}
+		})
+	}
+}
+
+func TestBskyClientReturnsXRPCErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "12")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := NewBskyClient(BskyConfig{PDS: srv.URL, Timeout: 5 * time.Second})
+	err := c.call(context.Background(), "com.atproto.identity.resolveHandle", "", nil, nil, "", nil)
+	if !IsXRPCError(err, xrpcRateLimitExceeded) {
+		t.Fatalf("call: %v, want %s", err, xrpcRateLimitExceeded)
+	}
+	var xe *XRPCError
+	if errors.As(err, &xe); xe.RetryAfter != 12*time.Second {
+		t.Errorf("RetryAfter = %v, want 12s", xe.RetryAfter)
+	}
+}
@@ -3,31 +3,71 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
+	"sync/atomic"
 	"time"
 
-	"github.com/gomarkdown/markdown"
-	"github.com/gorilla/feeds"
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/logging"
+	"github.com/aghdom/current/search"
 )
 
+// lastChange holds the UnixNano time of the latest write to the posts, used for HTTP caching.
+var lastChange atomic.Int64
+
+// LastChange returns the time of the latest write to the posts.
+// Right after start-up, it is the time of the newest post.
+func LastChange() time.Time {
+	return time.Unix(0, lastChange.Load()).UTC()
+}
+
+func touch() {
+	lastChange.Store(time.Now().UnixNano())
+	resetFeedCache()
+}
+
 type Post struct {
 	Time    time.Time
 	Content []byte
 	BskyURI []byte
+	// Preview of the first external link in the post, if one could be fetched
+	Preview *LinkPreview
+	// Offset is the author's UTC offset in seconds when writing the post, nil for posts written before it was recorded
+	Offset *int
+}
+
+// LocalTime returns the creation time of the post at the author's UTC offset, or in 'loc' if it is unknown.
+func (p Post) LocalTime(loc *time.Location) time.Time {
+	if p.Offset == nil {
+		return p.Time.In(loc)
+	}
+	return p.Time.In(time.FixedZone("", *p.Offset))
+}
+
+var (
+	// ErrNotFound is returned when a requested post does not exist.
+	ErrNotFound = errors.New("post not found")
+	// ErrDeleted is returned when a requested post existed, but has since been deleted.
+	ErrDeleted = errors.New("post deleted")
+)
+
+// openDB opens the SQLite DB configured in "sqlite.filepath".
+func openDB() (*sql.DB, error) {
+	return sql.Open(driverName, viper.GetString("sqlite.filepath"))
 }
 
 // runDBMigrationTX runs SQL database migration queries in a single transaction.
 // It starts a new transaction in 'db' and executes the query strings in 'queries' one by one.
 // Lastly, it updates "user_version" to the next one after the current 'dbVersion'.
-func runDBMigrationTx(db *sql.DB, dbVersion int, queries []string) {
+func runDBMigrationTx(db *sql.DB, dbVersion int, queries []string) error {
 	ctx := context.Background()
 	tx, err := db.BeginTx(ctx, nil)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	// Defer transaction rollback in case anything goes wrong
 	defer tx.Rollback()
@@ -36,261 +76,502 @@ func runDBMigrationTx(db *sql.DB, dbVersion int, queries []string) {
 	for _, query := range queries {
 		_, qErr := tx.ExecContext(ctx, query)
 		if qErr != nil {
-			log.Fatal(qErr)
+			return fmt.Errorf("migration to version %d: %w", dbVersion+1, qErr)
 		}
 	}
 	// Increment DB version
 	newVersion := dbVersion + 1
 	_, err = tx.ExecContext(ctx, fmt.Sprintf("PRAGMA user_version = %d", newVersion))
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
 	// Commit transaction
-	if err = tx.Commit(); err != nil {
-		log.Fatal(err)
-	}
+	return tx.Commit()
 }
-func InitDB() {
+
+// SchemaVersion is the "user_version" of the DB once all the migrations in InitDB have run.
+// When adding a new migration, remember to bump it as well.
+const SchemaVersion = 8
+
+func InitDB() error {
 	fp := viper.GetString("sqlite.filepath")
 	if _, err := os.Stat(fp); os.IsNotExist(err) {
-		_, createErr := os.Create(fp)
+		f, createErr := os.Create(fp)
 		if createErr != nil {
-			log.Fatal(err)
+			return createErr
 		}
-		fmt.Println("Created DB file: " + fp)
+		f.Close()
+		slog.Info("Created DB file", "path", fp)
 	}
-	db, err := sql.Open("sqlite3", fp)
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer db.Close()
 
 	// Check current DB version
-	rows, err := db.Query("PRAGMA user_version")
-	if err != nil {
-		log.Fatal(err)
-	}
-	rows.Next()
 	var dbVersion int
-	if err := rows.Scan(&dbVersion); err != nil {
-		log.Fatal(err)
+	if err := db.QueryRow("PRAGMA user_version").Scan(&dbVersion); err != nil {
+		return err
 	}
-	rows.Close()
 
 	// If necessary, execute all missed migrations for the current DB
-	// When adding a new migration, remember to add 'fallthrough' to the previous one
+	// When adding a new migration, remember to add 'fallthrough' to the previous one and bump SchemaVersion
+	var mErr error
 	switch dbVersion {
 	case 0:
-		runDBMigrationTx(db, 0, []string{"CREATE TABLE IF NOT EXISTS posts(ts INTEGER PRIMARY KEY, content TEXT)"})
+		mErr = runDBMigrationTx(db, 0, []string{"CREATE TABLE IF NOT EXISTS posts(ts INTEGER PRIMARY KEY, content TEXT)"})
+		if mErr != nil {
+			break
+		}
 		fallthrough
 	case 1:
 		// Introduced a 'bsky_uri' field to store BlueSky uri for deletion purposes in case of federation
-		runDBMigrationTx(db, 1, []string{"ALTER TABLE posts ADD bsky_uri TEXT"})
+		mErr = runDBMigrationTx(db, 1, []string{"ALTER TABLE posts ADD bsky_uri TEXT"})
+		if mErr != nil {
+			break
+		}
+		fallthrough
+	case 2:
+		// Introduced tombstones for deleted posts, so their permalinks can respond with '410 Gone'
+		mErr = runDBMigrationTx(db, 2, []string{"CREATE TABLE IF NOT EXISTS deleted_posts(ts INTEGER PRIMARY KEY, deleted INTEGER)"})
+		if mErr != nil {
+			break
+		}
+		fallthrough
+	case 3:
+		// Introduced link previews, cached by URL and referenced by the posts linking to them
+		mErr = runDBMigrationTx(db, 3, []string{
+			"CREATE TABLE IF NOT EXISTS link_previews(url TEXT PRIMARY KEY, title TEXT, description TEXT, image TEXT, site_name TEXT, fetched INTEGER)",
+			"ALTER TABLE posts ADD preview_url TEXT",
+		})
+		if mErr != nil {
+			break
+		}
+		fallthrough
+	case 4:
+		// Introduced WebSub subscriptions of the built-in hub
+		mErr = runDBMigrationTx(db, 4, []string{
+			"CREATE TABLE IF NOT EXISTS websub_subscriptions(callback TEXT, topic TEXT, secret TEXT, expires INTEGER, PRIMARY KEY (callback, topic))",
+		})
+		if mErr != nil {
+			break
+		}
+		fallthrough
+	case 5:
+		// Introduced the author's UTC offset, so posts can show the local time they were written at
+		mErr = runDBMigrationTx(db, 5, []string{"ALTER TABLE posts ADD utc_offset INTEGER"})
+		if mErr != nil {
+			break
+		}
+		fallthrough
+	case 6:
+		// Introduced the Bluesky session, optionally stored so it's reused across restarts
+		mErr = runDBMigrationTx(db, 6, []string{
+			"CREATE TABLE IF NOT EXISTS bsky_session(id INTEGER PRIMARY KEY CHECK (id = 1), did TEXT, handle TEXT, access_jwt TEXT, refresh_jwt TEXT, updated INTEGER)",
+		})
+		if mErr != nil {
+			break
+		}
+		fallthrough
+	case 7:
+		// Introduced the federation outbox, so federating is retried until Bluesky accepts it
+		mErr = runDBMigrationTx(db, 7, []string{
+			"CREATE TABLE IF NOT EXISTS outbox(id INTEGER PRIMARY KEY AUTOINCREMENT, kind TEXT, post_ts INTEGER, bsky_uri TEXT, state TEXT, attempts INTEGER, next_attempt INTEGER, last_error TEXT, created INTEGER, updated INTEGER)",
+			"CREATE INDEX IF NOT EXISTS outbox_due ON outbox(state, next_attempt)",
+		})
 	}
+	if mErr != nil {
+		return mErr
+	}
+
+	var newest sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(ts) FROM posts").Scan(&newest); err != nil {
+		return err
+	}
+	lastChange.Store(time.Unix(newest.Int64, 0).UnixNano())
+	return nil
 }
 
-func CountPosts(query string) int {
-	fp := viper.GetString("sqlite.filepath")
-	db, err := sql.Open("sqlite3", fp)
+// CountPosts returns the number of posts matching 'q'.
+func CountPosts(q search.Query) (int, error) {
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return 0, err
 	}
 	defer db.Close()
-	rows, err := db.Query("SELECT COUNT(ts) AS count FROM posts WHERE content LIKE ?", "%"+query+"%")
-	if err != nil {
-		log.Fatal(err)
-	}
 
-	defer rows.Close()
-	rows.Next()
+	where, args := searchClause(q)
 	var count int
-	if err := rows.Scan(&count); err != nil {
-		log.Fatal(err)
+	err = db.QueryRow("SELECT COUNT(ts) AS count FROM posts"+where, args...).Scan(&count)
+	return count, err
+}
+
+func offsetPtr(offset sql.NullInt32) *int {
+	if !offset.Valid {
+		return nil
 	}
-	return count
+	o := int(offset.Int32)
+	return &o
 }
 
-func queryPosts(query string, args ...any) []Post {
-	fp := viper.GetString("sqlite.filepath")
+func queryPosts(query string, args ...any) ([]Post, error) {
 	var result []Post
-	db, err := sql.Open("sqlite3", fp)
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer db.Close()
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	defer rows.Close()
 	for rows.Next() {
 		var post Post
 		var ts int64
-		if err := rows.Scan(&ts, &post.Content); err != nil {
-			log.Fatal(err)
+		var offset sql.NullInt32
+		if err := rows.Scan(&ts, &post.Content, &offset); err != nil {
+			return nil, err
 		}
 		post.Time = time.Unix(ts, 0).Truncate(time.Second).UTC()
+		post.Offset = offsetPtr(offset)
 		result = append(result, post)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return result
+	return result, attachPreviews(db, result)
 }
 
-func queryPostsWithURI(query string, args ...any) []Post {
-	fp := viper.GetString("sqlite.filepath")
+func queryPostsWithURI(query string, args ...any) ([]Post, error) {
 	var result []Post
-	db, err := sql.Open("sqlite3", fp)
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer db.Close()
 
 	rows, err := db.Query(query, args...)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
 	defer rows.Close()
 	for rows.Next() {
 		var post Post
 		var ts int64
-		if err := rows.Scan(&ts, &post.Content, &post.BskyURI); err != nil {
-			log.Fatal(err)
+		var offset sql.NullInt32
+		if err := rows.Scan(&ts, &post.Content, &offset, &post.BskyURI); err != nil {
+			return nil, err
 		}
 		post.Time = time.Unix(ts, 0).Truncate(time.Second).UTC()
+		post.Offset = offsetPtr(offset)
 		result = append(result, post)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
 
-	return result
+	return result, attachPreviews(db, result)
 }
 
-func GetPosts(page, count int, query string) []Post {
-	if query != "" {
-		return queryPosts("SELECT ts,content FROM posts WHERE content LIKE ? ORDER BY ts DESC LIMIT ?,?", "%"+query+"%", count*(page-1), count)
+// GetPostTimes returns the creation times of the posts on 'page', newest first.
+// It is a lightweight alternative to GetPostsPage, when the content is not needed.
+func GetPostTimes(page, count int) ([]time.Time, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT ts FROM posts ORDER BY ts DESC LIMIT ?,?", count*(page-1), count)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []time.Time
+	for rows.Next() {
+		var ts int64
+		if err := rows.Scan(&ts); err != nil {
+			return nil, err
+		}
+		result = append(result, time.Unix(ts, 0).UTC())
 	}
-	return queryPosts("SELECT ts,content FROM posts ORDER BY ts DESC LIMIT ?,?", count*(page-1), count)
+	return result, rows.Err()
 }
 
-func GetPostByTime(tm time.Time) (Post, bool) {
-	posts := queryPostsWithURI("SELECT ts,content,bsky_uri FROM posts WHERE ts == ? ORDER BY ts DESC", tm.Unix())
+// GetPostByTime returns the post created at 'tm'.
+// If there is no such post, ErrDeleted or ErrNotFound is returned, depending on whether it has been deleted.
+func GetPostByTime(tm time.Time) (Post, error) {
+	posts, err := queryPostsWithURI("SELECT ts,content,utc_offset,bsky_uri FROM posts WHERE ts == ? ORDER BY ts DESC", tm.Unix())
+	if err != nil {
+		return Post{}, err
+	}
 	if len(posts) > 0 {
-		return posts[0], true
+		return posts[0], nil
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return Post{}, err
+	}
+	defer db.Close()
+	var deleted int
+	if err := db.QueryRow("SELECT COUNT(ts) FROM deleted_posts WHERE ts == ?", tm.Unix()).Scan(&deleted); err != nil {
+		return Post{}, err
+	}
+	if deleted > 0 {
+		return Post{}, ErrDeleted
 	}
-	return Post{}, false
+	return Post{}, ErrNotFound
 }
 
-func GetPostOnDate(dt time.Time) []Post {
-	return queryPosts("SELECT ts,content FROM posts WHERE ? <= ts AND ts < ? ORDER BY ts DESC", dt.Unix(), dt.Add(24*time.Hour).Unix())
+func GetPostOnDate(dt time.Time) ([]Post, error) {
+	return GetPostsBetween(dt, dt.AddDate(0, 0, 1))
 }
 
-func insertPost(post Post) {
-	fp := viper.GetString("sqlite.filepath")
-	db, err := sql.Open("sqlite3", fp)
+// GetPostsBetween returns the posts created in the half-open interval ['from', 'to').
+func GetPostsBetween(from, to time.Time) ([]Post, error) {
+	return queryPosts("SELECT ts,content,utc_offset FROM posts WHERE ? <= ts AND ts < ? ORDER BY ts DESC", from.Unix(), to.Unix())
+}
+
+// PostTimeRange returns the creation times of the oldest and the newest post.
+// If there are no posts, both are zero.
+func PostTimeRange() (time.Time, time.Time, error) {
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return time.Time{}, time.Time{}, err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("INSERT INTO posts(ts, content, bsky_uri) VALUES (?, ?, ?);", post.Time.Unix(), post.Content, post.BskyURI)
-	if err != nil {
-		log.Fatal(err)
+	var first, last sql.NullInt64
+	if err := db.QueryRow("SELECT MIN(ts), MAX(ts) FROM posts").Scan(&first, &last); err != nil {
+		return time.Time{}, time.Time{}, err
 	}
+	if !first.Valid {
+		return time.Time{}, time.Time{}, nil
+	}
+	return time.Unix(first.Int64, 0).UTC(), time.Unix(last.Int64, 0).UTC(), nil
 }
 
-func CreatePost(content string, bskyFed bool) {
-	var bskyUri string
-	t := time.Now().UTC()
-	if bskyFed {
-		uri, err := BskyCreatePost(content, t)
-		if err != nil {
-			log.Fatal(err)
-		}
-		bskyUri = uri
-	}
-	insertPost(Post{
-		Time:    t.Truncate(time.Second),
-		Content: []byte(content),
-		BskyURI: []byte(bskyUri),
-	})
+// DayCount is the number of posts created on a single day.
+type DayCount struct {
+	// Day is the date at midnight UTC, regardless of the timezone the posts were counted in
+	Day   time.Time
+	Count int
 }
 
-func deletePost(tm time.Time) {
-	fp := viper.GetString("sqlite.filepath")
-	db, err := sql.Open("sqlite3", fp)
+// CountPostsPerDay returns the number of posts for every day in 'loc' with at least one post, oldest first.
+func CountPostsPerDay(loc *time.Location) ([]DayCount, error) {
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 	defer db.Close()
 
-	_, err = db.Exec("DELETE FROM posts WHERE ts == ?", tm.Unix())
+	// SQLite only knows fixed offsets, so the days are split here to get the DST transitions right
+	rows, err := db.Query("SELECT ts FROM posts ORDER BY ts")
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-}
+	defer rows.Close()
 
-func DeletePostByTime(tm time.Time, bskyDel bool) {
-	if bskyDel {
-		post, ok := GetPostByTime(tm)
-		if !ok {
-			return
+	var result []DayCount
+	for rows.Next() {
+		var ts int64
+		if err := rows.Scan(&ts); err != nil {
+			return nil, err
 		}
-		if err := BskyDeletePost(string(post.BskyURI)); err != nil {
-			log.Fatal(err)
+		y, m, d := time.Unix(ts, 0).In(loc).Date()
+		day := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+		if n := len(result); n > 0 && result[n-1].Day.Equal(day) {
+			result[n-1].Count++
+			continue
 		}
+		result = append(result, DayCount{Day: day, Count: 1})
 	}
-	deletePost(tm)
+	return result, rows.Err()
 }
 
-func getFeed() *feeds.Feed {
-	feed := &feeds.Feed{
-		Title:       "aghdom's current",
-		Link:        &feeds.Link{Href: "https://current.aghdom.eu/"},
-		Description: "My personal micro-blog",
-		Author:      &feeds.Author{Name: "Dominik Ágh", Email: "agh.dominik@gmail.com"},
+// insertPost stores 'post', along with a job federating it, if 'bskyFed' is set.
+func insertPost(post Post, bskyFed bool) error {
+	db, err := openDB()
+	if err != nil {
+		return err
 	}
+	defer db.Close()
 
-	posts := queryPosts("SELECT ts,content FROM posts ORDER BY ts DESC")
-	feed.Created = posts[0].Time
-
-	for _, post := range posts {
-		feed.Items = append(feed.Items, &feeds.Item{
-			Title:   post.Time.Format("2006/01/02 15:04"),
-			Link:    &feeds.Link{Href: fmt.Sprintf("https://current.aghdom.eu/posts/%d", post.Time.Unix())},
-			Author:  &feeds.Author{Name: "Dominik Ágh", Email: "agh.dominik@gmail.com"},
-			Content: string(markdown.ToHTML(markdown.NormalizeNewlines(post.Content), nil, nil)),
-			Created: post.Time,
-		})
+	var previewURL sql.NullString
+	if post.Preview != nil {
+		previewURL = sql.NullString{String: post.Preview.URL, Valid: true}
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
 	}
+	defer tx.Rollback()
+	_, err = tx.Exec("INSERT INTO posts(ts, content, bsky_uri, preview_url, utc_offset) VALUES (?, ?, ?, ?, ?);",
+		post.Time.Unix(), post.Content, post.BskyURI, previewURL, post.Offset)
+	if err != nil {
+		return err
+	}
+	if bskyFed {
+		if err := enqueueTx(tx, OutboxCreate, post.Time, ""); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	touch()
+	return nil
+}
 
-	return feed
+// CreatePost creates a post written by the author at the UTC offset of 'offset' seconds
+// and queues it to be federated to Bluesky, if 'bskyFed' is set.
+func CreatePost(content string, bskyFed bool, offset int) error {
+	post := Post{
+		Time:    time.Now().UTC().Truncate(time.Second),
+		Content: []byte(content),
+		Preview: previewFor(content),
+		Offset:  &offset,
+	}
+	if err := insertPost(post, bskyFed); err != nil {
+		return err
+	}
+	slog.Info("Created post", logging.Post(post.Time))
+	if bskyFed {
+		queuedFederation(OutboxCreate, post.Time)
+	}
+	notify(PostCreated, post.Time)
+	return nil
 }
 
-func GetAtomFeed() []byte {
-	feed := getFeed()
-	atom, err := feed.ToAtom()
+// UpdatePost replaces the content of the post created at 'tm' and fetches its link preview anew.
+// The federated copy is left as it is, as Bluesky doesn't support editing posts, see RefederatePost.
+func UpdatePost(tm time.Time, content string) error {
+	preview := previewFor(content)
+	var previewURL sql.NullString
+	if preview != nil {
+		previewURL = sql.NullString{String: preview.URL, Valid: true}
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	res, err := db.Exec("UPDATE posts SET content = ?, preview_url = ? WHERE ts == ?", content, previewURL, tm.Unix())
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNotFound
 	}
-	return []byte(atom)
+	touch()
+	slog.Info("Updated post", logging.Post(tm))
+	notify(PostUpdated, tm)
+	return nil
 }
 
-func GetRssFeed() []byte {
-	feed := getFeed()
-	rss, err := feed.ToRss()
+// RefederatePost queues the post created at 'tm' to be posted to Bluesky again, replacing its previous federated copy, if any.
+// Unfinished jobs federating the post are superseded, so it's only posted once.
+func RefederatePost(tm time.Time) error {
+	if _, err := GetPostByTime(tm); err != nil {
+		return err
+	}
+
+	db, err := openDB()
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := cancelCreateJobsTx(tx, tm, "superseded"); err != nil {
+		return err
+	}
+	if err := enqueueTx(tx, OutboxCreate, tm, ""); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
 	}
-	return []byte(rss)
+	queuedFederation(OutboxCreate, tm)
+	return nil
 }
 
-func GetJsonFeed() []byte {
-	feed := getFeed()
-	json, err := feed.ToJSON()
+// deletePost removes the post created at 'tm' and leaves a tombstone in its place.
+// Unfinished jobs federating the post are cancelled and if 'bskyURI' isn't empty, a job deleting the federated copy is queued.
+func deletePost(tm time.Time, bskyURI string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Posts deleted before they were federated are never posted. The jobs are cancelled while the post still exists,
+	// so the copy stored with it is only deleted, if 'bskyURI' says so.
+	if err := cancelCreateJobsTx(tx, tm, errPostGone.Error()); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM posts WHERE ts == ?", tm.Unix())
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		_, err = tx.Exec("INSERT OR REPLACE INTO deleted_posts(ts, deleted) VALUES (?, ?)", tm.Unix(), time.Now().Unix())
+		if err != nil {
+			return err
+		}
+	}
+	if bskyURI != "" {
+		if err := enqueueTx(tx, OutboxDelete, tm, bskyURI); err != nil {
+			return err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	touch()
+	return nil
+}
+
+// DeletePostByTime deletes the post created at 'tm' and queues its federated copy to be deleted, if 'bskyDel' is set.
+func DeletePostByTime(tm time.Time, bskyDel bool) error {
+	var bskyURI string
+	if bskyDel {
+		post, err := GetPostByTime(tm)
+		if err != nil {
+			return err
+		}
+		// Posts which were never federated have nothing to delete on Bluesky
+		bskyURI = string(post.BskyURI)
+	}
+	if err := deletePost(tm, bskyURI); err != nil {
+		return err
+	}
+	slog.Info("Deleted post", logging.Post(tm))
+	if bskyURI != "" {
+		queuedFederation(OutboxDelete, tm)
 	}
-	return []byte(json)
+	notify(PostDeleted, tm)
+	return nil
 }
@@ -0,0 +1,42 @@
+package data
+
+import (
+	"sync"
+	"time"
+)
+
+// ChangeKind tells what happened to a post.
+type ChangeKind string
+
+const (
+	PostCreated ChangeKind = "created"
+	PostUpdated ChangeKind = "updated"
+	PostDeleted ChangeKind = "deleted"
+)
+
+// Change describes a change to a single post, identified by its creation time.
+type Change struct {
+	Kind ChangeKind
+	Time time.Time
+}
+
+var observers struct {
+	sync.RWMutex
+	fns []func(Change)
+}
+
+// OnChange registers 'fn' to be called after every change to the posts.
+// It is called synchronously by the writer, so it should hand off any slow work.
+func OnChange(fn func(Change)) {
+	observers.Lock()
+	defer observers.Unlock()
+	observers.fns = append(observers.fns, fn)
+}
+
+func notify(kind ChangeKind, tm time.Time) {
+	observers.RLock()
+	defer observers.RUnlock()
+	for _, fn := range observers.fns {
+		fn(Change{Kind: kind, Time: tm})
+	}
+}
@@ -0,0 +1,331 @@
+package data
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/feeds"
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/render"
+	"github.com/aghdom/current/search"
+	"github.com/aghdom/current/site"
+)
+
+// FeedFormat identifies one of the alternate feed formats.
+type FeedFormat int
+
+const (
+	FeedAtom FeedFormat = iota
+	FeedRSS
+	FeedJSON
+)
+
+// Path returns the path on which the feed format is served.
+func (f FeedFormat) Path() string {
+	switch f {
+	case FeedAtom:
+		return "/current.atom"
+	case FeedRSS:
+		return "/index.xml"
+	default:
+		return "/index.json"
+	}
+}
+
+// ContentType returns the media type of the feed format.
+func (f FeedFormat) ContentType() string {
+	switch f {
+	case FeedAtom:
+		return "application/atom+xml"
+	case FeedRSS:
+		return "application/rss+xml"
+	default:
+		return "application/json"
+	}
+}
+
+// feedCache holds the generated feeds until the next write to the posts.
+var feedCache = struct {
+	sync.Mutex
+	entries map[string][]byte
+}{entries: map[string][]byte{}}
+
+func resetFeedCache() {
+	feedCache.Lock()
+	defer feedCache.Unlock()
+	feedCache.entries = map[string][]byte{}
+}
+
+// feedPageURL returns the URL of the page of a feed served on 'path', with the cursor 'key' set to 'tm'.
+// Without a cursor, it's the URL of the first page, which is the feed itself.
+func feedPageURL(cfg site.Config, path, key string, tm time.Time) string {
+	if tm.IsZero() {
+		return cfg.URL(path)
+	}
+	return cfg.URL(fmt.Sprintf("%s?%s=%d", path, key, tm.Unix()))
+}
+
+// feedPage is a single page of a paged feed, as defined in RFC 5005, Section 3.
+type feedPage struct {
+	*feeds.Feed
+	Self string
+	// First is set on the first page, with the newest posts
+	First bool
+	// Previous and Next are the URLs of the pages of newer and older posts, if there are any
+	Previous string
+	Next     string
+}
+
+// links returns the RFC 5005 paging links of the page, with the "self" link included.
+// There is no "last" link, as it would have to be counted. The first page, which is the WebSub topic, also links to the hubs.
+func (p feedPage) links(cfg site.Config, path string) []feeds.AtomLink {
+	links := []feeds.AtomLink{
+		{Rel: "self", Href: p.Self},
+		{Rel: "first", Href: feedPageURL(cfg, path, "", time.Time{})},
+	}
+	if p.First {
+		for _, hub := range FeedHubs(cfg) {
+			links = append(links, feeds.AtomLink{Rel: "hub", Href: hub})
+		}
+	}
+	if p.Previous != "" {
+		links = append(links, feeds.AtomLink{Rel: "previous", Href: p.Previous})
+	}
+	if p.Next != "" {
+		links = append(links, feeds.AtomLink{Rel: "next", Href: p.Next})
+	}
+	return links
+}
+
+// FeedItems returns the number of items per page of the feeds, configured in "feed.items".
+func FeedItems() int {
+	if n := viper.GetInt("feed.items"); n > 0 {
+		return n
+	}
+	return 20
+}
+
+// newFeed returns a feed of 'posts', with the site's metadata.
+func newFeed(cfg site.Config, posts []Post) *feeds.Feed {
+	var author *feeds.Author
+	if cfg.Author.Name != "" {
+		author = &feeds.Author{Name: cfg.Author.Name, Email: cfg.Author.Email}
+	}
+	feed := &feeds.Feed{
+		Title:       cfg.Title,
+		Link:        &feeds.Link{Href: cfg.URL("/")},
+		Description: cfg.Description,
+		Author:      author,
+		Updated:     LastChange().In(cfg.Location),
+	}
+	// An empty feed is still valid, but requires an update time
+	if feed.Updated.Unix() == 0 {
+		feed.Updated = time.Now().In(cfg.Location)
+	}
+	if len(posts) > 0 {
+		feed.Created = posts[0].LocalTime(cfg.Location)
+	}
+
+	for _, post := range posts {
+		feed.Items = append(feed.Items, &feeds.Item{
+			Title:   post.Time.In(cfg.Location).Format("2006/01/02 15:04"),
+			Link:    &feeds.Link{Href: cfg.URL(fmt.Sprintf("/posts/%d", post.Time.Unix()))},
+			Author:  author,
+			Content: string(render.FeedMarkdown(post.Content)),
+			// Timestamps keep the author's offset
+			Created: post.LocalTime(cfg.Location),
+		})
+	}
+	return feed
+}
+
+// getFeedPage returns the page of the feed with the posts created before 'before' or after 'after', like GetPostsPage.
+// The number of items per page is configured in "feed.items". ErrNotFound is returned for cursors past the end of the feed.
+func getFeedPage(cfg site.Config, path string, before, after time.Time) (feedPage, error) {
+	page, err := GetPostsPage(search.Query{}, before, after, FeedItems())
+	if err != nil {
+		return feedPage{}, err
+	}
+	if len(page.Posts) == 0 && (!before.IsZero() || !after.IsZero()) {
+		// Past the end of the feed, e.g. after the posts of an old cursor were deleted
+		return feedPage{}, ErrNotFound
+	}
+	// A page after a cursor is the first one, once there are too few newer posts
+	fp := feedPage{Feed: newFeed(cfg, page.Posts), First: !page.Newer}
+	switch {
+	case fp.First:
+		fp.Self = feedPageURL(cfg, path, "", time.Time{})
+	case !after.IsZero():
+		fp.Self = feedPageURL(cfg, path, "after", after)
+	default:
+		fp.Self = feedPageURL(cfg, path, "before", before)
+	}
+	if page.Newer {
+		fp.Previous = feedPageURL(cfg, path, "after", page.Posts[0].Time)
+	}
+	if page.Older {
+		fp.Next = feedPageURL(cfg, path, "before", page.Posts[len(page.Posts)-1].Time)
+	}
+	return fp, nil
+}
+
+// atomID returns the ID of the item's Atom entry. It is a tag URI like the one generated by feeds.Atom,
+// but dated in UTC, so that the IDs don't change with the timezone of the site.
+func atomID(item *feeds.Item) string {
+	u, err := url.Parse(item.Link.Href)
+	if err != nil {
+		return item.Link.Href
+	}
+	return fmt.Sprintf("tag:%s,%s:%s", u.Host, item.Created.UTC().Format("2006-01-02"), u.Path)
+}
+
+// atomFeed is an Atom feed with the RFC 5005 paging links.
+type atomFeed struct {
+	*feeds.AtomFeed
+	// Links shadows the single link of feeds.AtomFeed
+	Links []feeds.AtomLink `xml:"link"`
+}
+
+func (a *atomFeed) FeedXml() interface{} {
+	return a
+}
+
+// rssAtomLink is an Atom link element embedded in an RSS channel.
+type rssAtomLink struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom link"`
+	Href    string   `xml:"href,attr"`
+	Rel     string   `xml:"rel,attr,omitempty"`
+}
+
+type rssChannel struct {
+	*feeds.RssFeed
+	Links []rssAtomLink
+}
+
+// rssFeed is an RSS feed with the RFC 5005 paging links, embedded as Atom links into the channel.
+type rssFeed struct {
+	XMLName          xml.Name    `xml:"rss"`
+	Version          string      `xml:"version,attr"`
+	ContentNamespace string      `xml:"xmlns:content,attr"`
+	Channel          *rssChannel `xml:"channel"`
+}
+
+func (r *rssFeed) FeedXml() interface{} {
+	return r
+}
+
+// jsonFeed is a JSON feed with its WebSub hubs.
+type jsonFeed struct {
+	*feeds.JSONFeed
+	// Hubs shadows the mistyped field of feeds.JSONFeed
+	Hubs []feeds.JSONHub `json:"hubs,omitempty"`
+}
+
+// generateFeed renders the page of the feed in 'format' with the posts created before 'before' or after 'after'.
+// The first pages, which are polled by the feed readers, are cached until the next write to the posts.
+// Older pages aren't, as any time is a valid cursor, and they're cheap to look up by it.
+func generateFeed(cfg site.Config, format FeedFormat, before, after time.Time) ([]byte, error) {
+	key := fmt.Sprint(format)
+	cache := before.IsZero() && after.IsZero()
+	version := lastChange.Load()
+	if cache {
+		feedCache.Lock()
+		cached, ok := feedCache.entries[key]
+		feedCache.Unlock()
+		if ok {
+			return cached, nil
+		}
+	}
+
+	path := format.Path()
+	fp, err := getFeedPage(cfg, path, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	var out string
+	switch format {
+	case FeedAtom:
+		af := &atomFeed{AtomFeed: (&feeds.Atom{Feed: fp.Feed}).AtomFeed()}
+		for i, item := range fp.Items {
+			af.Entries[i].Id = atomID(item)
+		}
+		af.Links = append([]feeds.AtomLink{{Rel: "alternate", Href: cfg.URL("/")}}, fp.links(cfg, path)...)
+		out, err = feeds.ToXML(af)
+	case FeedRSS:
+		rf := &rssFeed{
+			Version:          "2.0",
+			ContentNamespace: "http://purl.org/rss/1.0/modules/content/",
+			Channel:          &rssChannel{RssFeed: (&feeds.Rss{Feed: fp.Feed}).RssFeed()},
+		}
+		for _, l := range fp.links(cfg, path) {
+			rf.Channel.Links = append(rf.Channel.Links, rssAtomLink{Href: l.Href, Rel: l.Rel})
+		}
+		out, err = feeds.ToXML(rf)
+	case FeedJSON:
+		jf := jsonFeed{JSONFeed: (&feeds.JSON{Feed: fp.Feed}).JSONFeed()}
+		jf.FeedUrl = fp.Self
+		jf.NextUrl = fp.Next
+		if fp.First {
+			for _, hub := range FeedHubs(cfg) {
+				jf.Hubs = append(jf.Hubs, feeds.JSONHub{Type: "WebSub", Url: hub})
+			}
+		}
+		var b []byte
+		b, err = json.MarshalIndent(jf, "", "  ")
+		out = string(b)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	feedCache.Lock()
+	// Don't cache a feed, which might have been made stale by a write during its generation
+	if cache && lastChange.Load() == version {
+		feedCache.entries[key] = []byte(out)
+	}
+	feedCache.Unlock()
+	return []byte(out), nil
+}
+
+// SearchPath is the path on which the Atom feeds of searches are served.
+const SearchPath = "/search.atom"
+
+// GetSearchFeed returns the Atom feed of the newest posts matching 'q'. Unlike the site's feeds,
+// it has a single page and isn't cached, as there are too many possible queries.
+func GetSearchFeed(cfg site.Config, q search.Query) ([]byte, error) {
+	page, err := GetPostsPage(q, time.Time{}, time.Time{}, FeedItems())
+	if err != nil {
+		return nil, err
+	}
+	feed := newFeed(cfg, page.Posts)
+	feed.Title = fmt.Sprintf("%s: search '%s'", cfg.Title, q.Raw)
+	feed.Link = &feeds.Link{Href: cfg.URL("/?" + url.Values{"q": {q.Raw}}.Encode())}
+
+	af := &atomFeed{AtomFeed: (&feeds.Atom{Feed: feed}).AtomFeed()}
+	for i, item := range feed.Items {
+		af.Entries[i].Id = atomID(item)
+	}
+	// The ID identifies the search, rather than the site
+	af.Id = cfg.URL(SearchPath + "?" + url.Values{"q": {q.Raw}}.Encode())
+	af.Links = []feeds.AtomLink{{Rel: "alternate", Href: feed.Link.Href}, {Rel: "self", Href: af.Id}}
+	out, err := feeds.ToXML(af)
+	return []byte(out), err
+}
+
+func GetAtomFeed(cfg site.Config, before, after time.Time) ([]byte, error) {
+	return generateFeed(cfg, FeedAtom, before, after)
+}
+
+func GetRssFeed(cfg site.Config, before, after time.Time) ([]byte, error) {
+	return generateFeed(cfg, FeedRSS, before, after)
+}
+
+func GetJsonFeed(cfg site.Config, before, after time.Time) ([]byte, error) {
+	return generateFeed(cfg, FeedJSON, before, after)
+}
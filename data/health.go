@@ -0,0 +1,63 @@
+package data
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// CheckDB verifies the DB can be queried and its directory written to, and returns the schema version.
+// A read-only volume still answers queries, so writability is checked separately.
+func CheckDB(ctx context.Context) (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version int
+	if err := db.QueryRowContext(ctx, "PRAGMA user_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	// SQLite needs to create journal files next to the DB to write to it
+	f, err := os.CreateTemp(filepath.Dir(viper.GetString("sqlite.filepath")), ".healthcheck-*")
+	if err != nil {
+		return version, err
+	}
+	f.Close()
+	return version, os.Remove(f.Name())
+}
+
+// DBFreeBytes returns the free space available on the volume of the DB.
+func DBFreeBytes() (uint64, error) {
+	return freeBytes(filepath.Dir(viper.GetString("sqlite.filepath")))
+}
+
+// BskySession is the outcome of the latest attempt to create a Bluesky session.
+type BskySession struct {
+	At  time.Time
+	Err error
+}
+
+var bskySession struct {
+	sync.Mutex
+	last BskySession
+}
+
+func recordBskySession(err error) {
+	bskySession.Lock()
+	defer bskySession.Unlock()
+	bskySession.last = BskySession{At: time.Now(), Err: err}
+}
+
+// LastBskySession returns the outcome of the latest attempt to create a Bluesky session.
+// It is zero, if there hasn't been one since start-up.
+func LastBskySession() BskySession {
+	bskySession.Lock()
+	defer bskySession.Unlock()
+	return bskySession.last
+}
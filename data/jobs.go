@@ -0,0 +1,33 @@
+package data
+
+import (
+	"context"
+	"sync"
+)
+
+// jobs tracks work started outside of a request, so that it can be drained on shutdown.
+var jobs sync.WaitGroup
+
+// RunBackground runs 'fn' in a new goroutine, which is waited for by WaitBackground.
+func RunBackground(fn func()) {
+	jobs.Add(1)
+	go func() {
+		defer jobs.Done()
+		fn()
+	}()
+}
+
+// WaitBackground blocks until all background jobs have finished or 'ctx' is done.
+func WaitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		jobs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
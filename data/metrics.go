@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/aghdom/current/metrics"
+)
+
+// driverName is the SQLite driver wrapped to record the duration and errors of every statement.
+const driverName = "sqlite3_instrumented"
+
+func init() {
+	sql.Register(driverName, instrumentedDriver{&sqlite3.SQLiteDriver{ConnectHook: registerFuncs}})
+}
+
+type instrumentedDriver struct {
+	*sqlite3.SQLiteDriver
+}
+
+func (d instrumentedDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.SQLiteDriver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return instrumentedConn{conn.(*sqlite3.SQLiteConn)}, nil
+}
+
+type instrumentedConn struct {
+	*sqlite3.SQLiteConn
+}
+
+func (c instrumentedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	res, err := c.SQLiteConn.ExecContext(ctx, query, args)
+	metrics.ObserveQuery(query, start, err)
+	return res, err
+}
+
+func (c instrumentedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.SQLiteConn.QueryContext(ctx, query, args)
+	if err != nil {
+		metrics.ObserveQuery(query, start, err)
+		return nil, err
+	}
+	return &instrumentedRows{Rows: rows, query: query, start: start}, nil
+}
+
+// instrumentedRows records the duration of a query once all of its rows have been read.
+type instrumentedRows struct {
+	driver.Rows
+	query string
+	start time.Time
+	err   error
+}
+
+func (r *instrumentedRows) Next(dest []driver.Value) error {
+	err := r.Rows.Next(dest)
+	if err != nil && err != io.EOF {
+		r.err = err
+	}
+	return err
+}
+
+func (r *instrumentedRows) Close() error {
+	metrics.ObserveQuery(r.query, r.start, r.err)
+	return r.Rows.Close()
+}
+
+// federationPending is the number of pending federation jobs, and federationDead of those which failed for good.
+var federationPending, federationDead atomic.Int64
+
+// FederationQueueDepth returns the number of posts currently waiting to be federated or deleted on Bluesky.
+func FederationQueueDepth() int {
+	return int(federationPending.Load())
+}
+
+// FederationDeadJobs returns the number of federation jobs, which have failed for good.
+func FederationDeadJobs() int {
+	return int(federationDead.Load())
+}
+
+// newBskyHTTP returns the client of the Bluesky API calls, recording their outcomes and latencies.
+func newBskyHTTP(timeout time.Duration) *http.Client {
+	return &http.Client{Transport: bskyTransport{http.DefaultTransport}, Timeout: timeout}
+}
+
+type bskyTransport struct {
+	next http.RoundTripper
+}
+
+func (t bskyTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// XRPC methods are named by the last path segment, e.g. "com.atproto.repo.createRecord"
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	start := time.Now()
+	res, err := t.next.RoundTrip(r)
+	metrics.BskyDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	switch {
+	case err != nil:
+		metrics.BskyRequests.WithLabelValues(method, "failure").Inc()
+	case res.StatusCode >= 200 && res.StatusCode < 300:
+		metrics.BskyRequests.WithLabelValues(method, "success").Inc()
+	default:
+		metrics.BskyRequests.WithLabelValues(method, "error").Inc()
+	}
+	return res, err
+}
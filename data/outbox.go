@@ -0,0 +1,519 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/logging"
+)
+
+// OutboxKind is the kind of a federation job.
+type OutboxKind string
+
+const (
+	// OutboxCreate posts a post to Bluesky, replacing its previous federated copy, if it has one
+	OutboxCreate OutboxKind = "create"
+	// OutboxDelete deletes a federated copy from Bluesky
+	OutboxDelete OutboxKind = "delete"
+)
+
+// OutboxState is the state of a federation job.
+type OutboxState string
+
+const (
+	// OutboxPending jobs are waiting for their next attempt
+	OutboxPending OutboxState = "pending"
+	// OutboxDone jobs have succeeded, or turned out to be unnecessary
+	OutboxDone OutboxState = "done"
+	// OutboxDead jobs have failed for good and are only attempted again when retried manually
+	OutboxDead OutboxState = "dead"
+)
+
+// OutboxJob is a change to federate to Bluesky. Jobs are stored along with the local change they belong to,
+// so they survive Bluesky being unavailable, and restarts.
+type OutboxJob struct {
+	ID   int64
+	Kind OutboxKind
+	// Post is the creation time of the post
+	Post time.Time
+	// BskyURI is the federated copy to delete, or the one created by a create job, once it has been
+	BskyURI     string
+	State       OutboxState
+	Attempts    int
+	NextAttempt time.Time
+	// LastError is the error of the latest failed attempt
+	LastError string
+	Created   time.Time
+	Updated   time.Time
+}
+
+// OutboxConfig configures the retries of the federation jobs.
+type OutboxConfig struct {
+	// MaxAttempts is the number of attempts, after which a job is dead
+	MaxAttempts int
+	// MinBackoff is the delay after the first failed attempt, doubled with every further one up to MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// Retention is how long finished jobs are kept
+	Retention time.Duration
+}
+
+func loadOutboxConfig() OutboxConfig {
+	return OutboxConfig{
+		MaxAttempts: max(viper.GetInt("outbox.max_attempts"), 1),
+		MinBackoff:  max(viper.GetDuration("outbox.min_backoff"), time.Second),
+		MaxBackoff:  max(viper.GetDuration("outbox.max_backoff"), time.Second),
+		Retention:   viper.GetDuration("outbox.retention"),
+	}
+}
+
+// ErrNoJob is returned when retrying a federation job which doesn't exist, or is already done.
+var ErrNoJob = errors.New("no such unfinished federation job")
+
+// outboxPoll is the longest the worker sleeps, so jobs retried from another process (e.g. the CLI) get picked up.
+const outboxPoll = time.Minute
+
+// outboxWake wakes the worker up when a job is enqueued or retried.
+var outboxWake = make(chan struct{}, 1)
+
+func wakeOutbox() {
+	select {
+	case outboxWake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueueTx adds a job of 'kind' for the post created at 'tm' to the outbox, as part of 'tx'.
+func enqueueTx(tx *sql.Tx, kind OutboxKind, tm time.Time, bskyURI string) error {
+	now := time.Now().Unix()
+	_, err := tx.Exec("INSERT INTO outbox(kind, post_ts, bsky_uri, state, attempts, next_attempt, last_error, created, updated) VALUES (?, ?, ?, ?, 0, ?, '', ?, ?)",
+		kind, tm.Unix(), bskyURI, OutboxPending, now, now, now)
+	return err
+}
+
+// cancelCreateJobsTx finishes the unfinished create jobs of the post created at 'tm' for 'reason', as part of 'tx'.
+// Copies already created by them, without being stored with the post, are queued to be deleted, unless they already are.
+func cancelCreateJobsTx(tx *sql.Tx, tm time.Time, reason string) error {
+	now := time.Now().Unix()
+	_, err := tx.Exec("INSERT INTO outbox(kind, post_ts, bsky_uri, state, attempts, next_attempt, last_error, created, updated) "+
+		"SELECT ?, post_ts, bsky_uri, ?, 0, ?, '', ?, ? FROM outbox AS c WHERE kind == ? AND post_ts == ? AND state != ? AND bsky_uri != '' "+
+		"AND bsky_uri NOT IN (SELECT bsky_uri FROM posts WHERE ts == c.post_ts AND bsky_uri IS NOT NULL) "+
+		"AND NOT EXISTS (SELECT 1 FROM outbox WHERE kind == ? AND bsky_uri == c.bsky_uri)",
+		OutboxDelete, OutboxPending, now, now, now, OutboxCreate, tm.Unix(), OutboxDone, OutboxDelete)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE outbox SET state = ?, last_error = ?, updated = ? WHERE kind == ? AND post_ts == ? AND state != ?",
+		OutboxDone, reason, now, OutboxCreate, tm.Unix(), OutboxDone)
+	return err
+}
+
+// enqueueDelete queues the federated copy 'bskyURI' of the post created at 'tm' to be deleted, unless it already is.
+func enqueueDelete(tm time.Time, bskyURI string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	res, err := db.Exec("INSERT INTO outbox(kind, post_ts, bsky_uri, state, attempts, next_attempt, last_error, created, updated) "+
+		"SELECT ?, ?, ?, ?, 0, ?, '', ?, ? WHERE NOT EXISTS (SELECT 1 FROM outbox WHERE kind == ? AND bsky_uri == ?)",
+		OutboxDelete, tm.Unix(), bskyURI, OutboxPending, now, now, now, OutboxDelete, bskyURI)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		queuedFederation(OutboxDelete, tm)
+	}
+	return nil
+}
+
+// enqueue adds a job of 'kind' for the post created at 'tm' to the outbox.
+func enqueue(kind OutboxKind, tm time.Time, bskyURI string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := enqueueTx(tx, kind, tm, bskyURI); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	queuedFederation(kind, tm)
+	return nil
+}
+
+// queuedFederation is called once a job has been committed, to log it and start working on it.
+func queuedFederation(kind OutboxKind, tm time.Time) {
+	slog.Info("Queued federation job", "kind", kind, logging.Post(tm))
+	federationPending.Add(1)
+	wakeOutbox()
+}
+
+const outboxColumns = "id, kind, post_ts, bsky_uri, state, attempts, next_attempt, last_error, created, updated"
+
+func queryOutbox(db *sql.DB, query string, args ...any) ([]OutboxJob, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []OutboxJob
+	for rows.Next() {
+		var job OutboxJob
+		var post, next, created, updated int64
+		err := rows.Scan(&job.ID, &job.Kind, &post, &job.BskyURI, &job.State, &job.Attempts, &next, &job.LastError, &created, &updated)
+		if err != nil {
+			return nil, err
+		}
+		job.Post = time.Unix(post, 0).UTC()
+		job.NextAttempt = time.Unix(next, 0).UTC()
+		job.Created = time.Unix(created, 0).UTC()
+		job.Updated = time.Unix(updated, 0).UTC()
+		result = append(result, job)
+	}
+	return result, rows.Err()
+}
+
+// OutboxJobs returns the latest 'limit' jobs in 'state', or in any state if it's empty, newest first.
+func OutboxJobs(state OutboxState, limit int) ([]OutboxJob, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	if state == "" {
+		return queryOutbox(db, "SELECT "+outboxColumns+" FROM outbox ORDER BY id DESC LIMIT ?", limit)
+	}
+	return queryOutbox(db, "SELECT "+outboxColumns+" FROM outbox WHERE state == ? ORDER BY id DESC LIMIT ?", state, limit)
+}
+
+// UnfinishedOutboxJobs returns the pending and dead jobs, oldest first.
+func UnfinishedOutboxJobs() ([]OutboxJob, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	return queryOutbox(db, "SELECT "+outboxColumns+" FROM outbox WHERE state != ? ORDER BY id", OutboxDone)
+}
+
+// CountOutboxJobs returns the number of jobs in each state.
+func CountOutboxJobs() (map[OutboxState]int, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT state, COUNT(id) FROM outbox GROUP BY state")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[OutboxState]int{}
+	for rows.Next() {
+		var state OutboxState
+		var n int
+		if err := rows.Scan(&state, &n); err != nil {
+			return nil, err
+		}
+		counts[state] = n
+	}
+	return counts, rows.Err()
+}
+
+// RetryOutboxJob schedules the pending or dead job 'id' to be attempted right away, with all of its attempts anew.
+// ErrNoJob is returned, if there is no such job, or it's done.
+func RetryOutboxJob(id int64) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	res, err := db.Exec("UPDATE outbox SET state = ?, attempts = 0, next_attempt = ?, updated = ? WHERE id == ? AND state != ?",
+		OutboxPending, now, now, id, OutboxDone)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrNoJob
+	}
+	slog.Info("Retrying federation job", "job", id)
+	syncOutboxGauges(db)
+	wakeOutbox()
+	return nil
+}
+
+// RetryDeadOutboxJobs schedules all the dead jobs to be attempted again and returns their number.
+func RetryDeadOutboxJobs() (int, error) {
+	db, err := openDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	res, err := db.Exec("UPDATE outbox SET state = ?, attempts = 0, next_attempt = ?, updated = ? WHERE state == ?",
+		OutboxPending, now, now, OutboxDead)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := res.RowsAffected()
+	if n > 0 {
+		slog.Info("Retrying dead federation jobs", "count", n)
+		syncOutboxGauges(db)
+		wakeOutbox()
+	}
+	return int(n), nil
+}
+
+// syncOutboxGauges counts the pending and dead jobs in the DB, which is the only complete view of them,
+// as they are also changed by other processes.
+func syncOutboxGauges(db *sql.DB) {
+	var pending, dead int64
+	err := db.QueryRow("SELECT COUNT(CASE WHEN state == ? THEN 1 END), COUNT(CASE WHEN state == ? THEN 1 END) FROM outbox",
+		OutboxPending, OutboxDead).Scan(&pending, &dead)
+	if err != nil {
+		slog.Warn("Failed to count federation jobs", logging.Err(err))
+		return
+	}
+	federationPending.Store(pending)
+	federationDead.Store(dead)
+}
+
+// RunOutbox works on the federation jobs until 'ctx' is done. A job in progress is finished before returning.
+func RunOutbox(ctx context.Context) {
+	cfg := loadOutboxConfig()
+	for {
+		next, err := runDueJobs(ctx, cfg)
+		if err != nil {
+			slog.Error("Failed to run federation jobs", logging.Err(err))
+		}
+		wait := outboxPoll
+		if !next.IsZero() {
+			wait = min(wait, time.Until(next))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-outboxWake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// runDueJobs attempts all the jobs which are due, oldest first, and returns when the next one will be.
+func runDueJobs(ctx context.Context, cfg OutboxConfig) (time.Time, error) {
+	db, err := openDB()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	if cfg.Retention > 0 {
+		cutoff := time.Now().Add(-cfg.Retention).Unix()
+		if _, err := db.Exec("DELETE FROM outbox WHERE state == ? AND updated < ?", OutboxDone, cutoff); err != nil {
+			return time.Time{}, err
+		}
+	}
+	defer syncOutboxGauges(db)
+
+	for ctx.Err() == nil {
+		jobs, err := queryOutbox(db, "SELECT "+outboxColumns+" FROM outbox WHERE state == ? ORDER BY next_attempt, id LIMIT 1", OutboxPending)
+		if err != nil || len(jobs) == 0 {
+			return time.Time{}, err
+		}
+		job := jobs[0]
+		if job.NextAttempt.After(time.Now()) {
+			return job.NextAttempt, nil
+		}
+		// A job in progress isn't cancelled, as a post could be created on Bluesky without its URI being stored.
+		// It's bounded by the client's timeout instead.
+		jobErr := runJob(context.WithoutCancel(ctx), db, &job)
+		if err := finishJob(db, cfg, job, jobErr); err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Time{}, nil
+}
+
+// errPostGone marks create jobs of posts deleted before they were federated, which are done without doing anything.
+var errPostGone = errors.New("post deleted before it was federated")
+
+// errJobCancelled marks jobs cancelled while they ran, by re-federating or deleting their post.
+var errJobCancelled = errors.New("cancelled while it ran")
+
+// runJob attempts 'job'. The copy created by a create job is set as its BskyURI.
+func runJob(ctx context.Context, db *sql.DB, job *OutboxJob) error {
+	bsky := bskyClient()
+	switch job.Kind {
+	case OutboxDelete:
+		return bsky.DeletePost(ctx, job.BskyURI)
+	case OutboxCreate:
+		post, err := GetPostByTime(job.Post)
+		gone := errors.Is(err, ErrNotFound) || errors.Is(err, ErrDeleted)
+		if err != nil && !gone {
+			return err
+		}
+		switch {
+		case job.BskyURI != "":
+			// The copy was created by a previous attempt, which failed to store it with the post
+		case gone:
+			return errPostGone
+		default:
+			// The copy to replace is read now, as an earlier job might have federated the post since this one was queued
+			if old := string(post.BskyURI); old != "" {
+				if err := bsky.DeletePost(ctx, old); err != nil {
+					return fmt.Errorf("deleting federated post: %w", err)
+				}
+				if _, err := db.Exec("UPDATE posts SET bsky_uri = NULL WHERE ts == ? AND bsky_uri == ?", job.Post.Unix(), old); err != nil {
+					return err
+				}
+			}
+			// The post keeps the time it was queued at, so a retried post isn't dated to the time Bluesky came back
+			uri, err := bsky.CreatePost(ctx, string(post.Content), job.Created, post.Preview)
+			if err != nil {
+				return err
+			}
+			job.BskyURI = uri
+			// The copy is stored with the job first, so a retry doesn't post it again
+			res, err := db.Exec("UPDATE outbox SET bsky_uri = ? WHERE id == ? AND state == ?", uri, job.ID, OutboxPending)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return errJobCancelled
+			}
+		}
+		return storeFederatedCopy(db, *job)
+	}
+	return fmt.Errorf("unknown federation job kind %q", job.Kind)
+}
+
+// storeFederatedCopy stores the copy created by the create 'job' with its post, unless the job has been cancelled.
+func storeFederatedCopy(db *sql.DB, job OutboxJob) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("UPDATE outbox SET updated = ? WHERE id == ? AND state == ?", time.Now().Unix(), job.ID, OutboxPending)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errJobCancelled
+	}
+	res, err = tx.Exec("UPDATE posts SET bsky_uri = ? WHERE ts == ?", job.BskyURI, job.Post.Unix())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return errPostGone
+	}
+	return tx.Commit()
+}
+
+// finishJob records the outcome 'jobErr' of an attempt at 'job' and schedules the next one, if it failed.
+// Jobs cancelled while they ran are left done, and a copy they created without storing it with the post is deleted.
+func finishJob(db *sql.DB, cfg OutboxConfig, job OutboxJob, jobErr error) error {
+	now := time.Now()
+	job.Attempts++
+	switch {
+	case jobErr == nil, errors.Is(jobErr, errPostGone), errors.Is(jobErr, errJobCancelled):
+		job.State, job.LastError = OutboxDone, ""
+		if jobErr != nil {
+			job.LastError = jobErr.Error()
+		}
+	case job.Attempts >= cfg.MaxAttempts || permanentXRPCError(jobErr):
+		job.State, job.LastError = OutboxDead, jobErr.Error()
+	default:
+		job.State, job.LastError = OutboxPending, jobErr.Error()
+		job.NextAttempt = now.Add(backoff(cfg, job.Attempts, jobErr))
+	}
+	res, err := db.Exec("UPDATE outbox SET state = ?, attempts = ?, next_attempt = ?, last_error = ?, updated = ? WHERE id == ? AND state == ?",
+		job.State, job.Attempts, job.NextAttempt.Unix(), job.LastError, now.Unix(), job.ID, OutboxPending)
+	if err != nil {
+		return err
+	}
+	cancelled := errors.Is(jobErr, errJobCancelled)
+	if n, _ := res.RowsAffected(); n == 0 {
+		cancelled = true
+	}
+
+	switch {
+	case cancelled:
+		slog.Info("Federation job was cancelled", "job", job.ID, "kind", job.Kind, logging.Post(job.Post))
+	case job.State == OutboxDone:
+		slog.Info("Finished federation job", "job", job.ID, "kind", job.Kind, logging.Post(job.Post))
+	case job.State == OutboxDead:
+		slog.Error("Federation job failed for good", "job", job.ID, "kind", job.Kind, logging.Post(job.Post),
+			"attempts", job.Attempts, logging.Err(jobErr))
+	default:
+		slog.Warn("Federation job failed", "job", job.ID, "kind", job.Kind, logging.Post(job.Post),
+			"attempts", job.Attempts, "retry_at", job.NextAttempt.UTC().Format(time.RFC3339), logging.Err(jobErr))
+	}
+	// A successful attempt has stored its copy with the post, which is then in charge of it
+	if job.Kind == OutboxCreate && job.BskyURI != "" && jobErr != nil && (cancelled || errors.Is(jobErr, errPostGone)) {
+		return enqueueDelete(job.Post, job.BskyURI)
+	}
+	return nil
+}
+
+// permanentXRPCError reports whether 'err' is a rejection, which won't succeed when retried, e.g. an invalid record.
+// Failed logins, timeouts and rate limits are worth retrying, as they go away by themselves or with a fixed configuration.
+func permanentXRPCError(err error) bool {
+	var xe *XRPCError
+	if !errors.As(err, &xe) || xe.Status < 400 || xe.Status > 499 {
+		return false
+	}
+	switch xe.Status {
+	case http.StatusUnauthorized, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	}
+	return xe.Name != xrpcExpiredToken && xe.Name != xrpcInvalidToken && xe.Name != xrpcRateLimitExceeded
+}
+
+// backoff returns the delay after 'attempts' failed attempts: exponential, with jitter spreading the retries
+// over the upper half of the delay. Rate limited jobs wait at least as long as Bluesky asks for.
+func backoff(cfg OutboxConfig, attempts int, err error) time.Duration {
+	delay := cfg.MinBackoff
+	for i := 1; i < attempts && delay < cfg.MaxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, cfg.MaxBackoff)
+	delay = delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+
+	var xe *XRPCError
+	if errors.As(err, &xe) && xe.RetryAfter > delay {
+		delay = xe.RetryAfter
+	}
+	return delay
+}
@@ -0,0 +1,308 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/html"
+
+	"github.com/aghdom/current/logging"
+	"github.com/aghdom/current/render"
+)
+
+// LinkPreview is the metadata of a linked page, shown as a card under the post linking to it.
+type LinkPreview struct {
+	URL         string
+	Title       string
+	Description string
+	Image       string
+	SiteName    string
+}
+
+// previewMaxAge is how long fetched previews are reused for new posts linking to the same URL.
+const previewMaxAge = 7 * 24 * time.Hour
+
+var errPrivateAddress = errors.New("refusing to connect to a non-public address")
+
+// cgnat is the shared address space (RFC 6598), which is not covered by net.IP.IsPrivate.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// isPublicIP reports whether 'ip' is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !cgnat.Contains(ip)
+}
+
+// newSafeClient returns an HTTP client for fetching user-provided URLs. To prevent SSRF, it only connects
+// to public IP addresses. The check runs after DNS resolution, so it covers redirects and DNS rebinding too.
+func newSafeClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errPrivateAddress
+			}
+			return nil
+		},
+	}
+	transport := &http.Transport{
+		DialContext:            dialer.DialContext,
+		TLSHandshakeTimeout:    timeout,
+		ResponseHeaderTimeout:  timeout,
+		MaxResponseHeaderBytes: 64 << 10,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("unsupported redirect scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+}
+
+// fetchLimited GETs 'target' with the safe client and returns at most 'limit' bytes of its body.
+func fetchLimited(ctx context.Context, target string, limit int64) ([]byte, string, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, "", fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("User-Agent", "current link preview (+https://github.com/aghdom/current)")
+
+	res, err := newSafeClient(viper.GetDuration("previews.timeout")).Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("fetching %s: status code %d", target, res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, limit))
+	return body, res.Header.Get("Content-Type"), err
+}
+
+// parsePreview extracts the OpenGraph metadata (falling back to the Twitter card and plain HTML metadata)
+// from the page at 'base'. It also returns the URL of the page's oEmbed endpoint, if it advertises one.
+func parsePreview(base *url.URL, body []byte) (LinkPreview, string) {
+	p := LinkPreview{URL: base.String()}
+	meta := map[string]string{}
+	var title, oembed string
+
+	z := html.NewTokenizer(strings.NewReader(string(body)))
+	inTitle := false
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		t := z.Token()
+		switch {
+		case tt == html.TextToken && inTitle:
+			title += t.Data
+		case tt == html.EndTagToken && t.Data == "title":
+			inTitle = false
+		case tt == html.EndTagToken && t.Data == "head":
+			// Metadata is only expected in the head, so the body doesn't need to be parsed
+			goto done
+		case tt == html.StartTagToken && t.Data == "title":
+			inTitle = true
+		case (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && t.Data == "meta":
+			key, content := "", ""
+			for _, a := range t.Attr {
+				switch a.Key {
+				case "property", "name":
+					key = strings.ToLower(a.Val)
+				case "content":
+					content = a.Val
+				}
+			}
+			if key != "" && meta[key] == "" {
+				meta[key] = strings.TrimSpace(content)
+			}
+		case (tt == html.StartTagToken || tt == html.SelfClosingTagToken) && t.Data == "link":
+			var rel, typ, href string
+			for _, a := range t.Attr {
+				switch a.Key {
+				case "rel":
+					rel = a.Val
+				case "type":
+					typ = a.Val
+				case "href":
+					href = a.Val
+				}
+			}
+			if rel == "alternate" && typ == "application/json+oembed" && oembed == "" {
+				oembed = resolveURL(base, href)
+			}
+		}
+	}
+done:
+	p.Title = firstNonEmpty(meta["og:title"], meta["twitter:title"], strings.TrimSpace(title))
+	p.Description = firstNonEmpty(meta["og:description"], meta["twitter:description"], meta["description"])
+	p.Image = resolveURL(base, firstNonEmpty(meta["og:image"], meta["og:image:url"], meta["twitter:image"]))
+	p.SiteName = firstNonEmpty(meta["og:site_name"], base.Hostname())
+	return p, oembed
+}
+
+type oembedResponse struct {
+	Title        string `json:"title"`
+	AuthorName   string `json:"author_name"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// FetchLinkPreview fetches the metadata of the page at 'target'. The page's oEmbed endpoint is
+// only consulted for the fields missing from its OpenGraph metadata.
+func FetchLinkPreview(ctx context.Context, target string) (LinkPreview, error) {
+	base, err := url.Parse(target)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	limit := viper.GetInt64("previews.max_bytes")
+	body, contentType, err := fetchLimited(ctx, target, limit)
+	if err != nil {
+		return LinkPreview{}, err
+	}
+	if !strings.Contains(contentType, "html") {
+		return LinkPreview{}, fmt.Errorf("unsupported content type %q", contentType)
+	}
+	p, oembedURL := parsePreview(base, body)
+
+	if oembedURL != "" && (p.Title == "" || p.Image == "") {
+		if ob, _, err := fetchLimited(ctx, oembedURL, limit); err == nil {
+			var oe oembedResponse
+			if json.Unmarshal(ob, &oe) == nil {
+				p.Title = firstNonEmpty(p.Title, oe.Title)
+				p.Image = firstNonEmpty(p.Image, resolveURL(base, oe.ThumbnailURL))
+				p.SiteName = firstNonEmpty(oe.ProviderName, p.SiteName)
+				p.Description = firstNonEmpty(p.Description, oe.AuthorName)
+			}
+		}
+	}
+	if p.Title == "" {
+		return LinkPreview{}, fmt.Errorf("no metadata found at %s", target)
+	}
+	return p, nil
+}
+
+func resolveURL(base *url.URL, ref string) string {
+	if ref == "" {
+		return ""
+	}
+	u, err := base.Parse(ref)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	return u.String()
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// getLinkPreview returns the preview of 'target', either from the cache, or freshly fetched and cached.
+func getLinkPreview(ctx context.Context, target string) (*LinkPreview, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var p LinkPreview
+	var fetched int64
+	err = db.QueryRow("SELECT url, title, description, image, site_name, fetched FROM link_previews WHERE url == ?", target).
+		Scan(&p.URL, &p.Title, &p.Description, &p.Image, &p.SiteName, &fetched)
+	if err == nil && time.Since(time.Unix(fetched, 0)) < previewMaxAge {
+		return &p, nil
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if p, err = FetchLinkPreview(ctx, target); err != nil {
+		return nil, err
+	}
+	_, err = db.Exec("INSERT OR REPLACE INTO link_previews(url, title, description, image, site_name, fetched) VALUES (?, ?, ?, ?, ?, ?)",
+		p.URL, p.Title, p.Description, p.Image, p.SiteName, time.Now().Unix())
+	return &p, err
+}
+
+// previewFor returns the preview of the first external link in 'content', or nil if there is none.
+// Failing to fetch a preview is not an error, the post is just shown without one.
+func previewFor(content string) *LinkPreview {
+	if !viper.GetBool("previews.enabled") {
+		return nil
+	}
+	link := render.FirstExternalLink([]byte(content))
+	if link == "" {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), viper.GetDuration("previews.timeout"))
+	defer cancel()
+	p, err := getLinkPreview(ctx, link)
+	if err != nil {
+		slog.Warn("Failed to fetch link preview", "url", link, logging.Err(err))
+		return nil
+	}
+	return p
+}
+
+// attachPreviews loads the link previews of 'posts' in a single query.
+func attachPreviews(db *sql.DB, posts []Post) error {
+	if len(posts) == 0 {
+		return nil
+	}
+	args := make([]any, len(posts))
+	idx := make(map[int64]int, len(posts))
+	for i, p := range posts {
+		args[i] = p.Time.Unix()
+		idx[p.Time.Unix()] = i
+	}
+	query := "SELECT p.ts, l.url, l.title, l.description, l.image, l.site_name FROM posts p " +
+		"JOIN link_previews l ON l.url == p.preview_url WHERE p.ts IN (?" + strings.Repeat(",?", len(posts)-1) + ")"
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ts int64
+		var p LinkPreview
+		if err := rows.Scan(&ts, &p.URL, &p.Title, &p.Description, &p.Image, &p.SiteName); err != nil {
+			return err
+		}
+		posts[idx[ts]].Preview = &p
+	}
+	return rows.Err()
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/aghdom/current/search"
+)
+
+// Patterns of 'has:' in the markdown of the posts, which covers both the markdown syntax and raw HTML.
+const (
+	linkPattern  = `(?i)https?://|\]\(|<a\s`
+	imagePattern = `(?i)!\[[^\]]*\]\(|<img\s`
+)
+
+// regexps caches the patterns compiled by the "REGEXP" operator.
+var regexps sync.Map
+
+// regexpMatch implements the "REGEXP" operator, which SQLite leaves to the application.
+func regexpMatch(pattern, s string) (bool, error) {
+	re, ok := regexps.Load(pattern)
+	if !ok {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return false, err
+		}
+		re, _ = regexps.LoadOrStore(pattern, compiled)
+	}
+	return re.(*regexp.Regexp).MatchString(s), nil
+}
+
+func registerFuncs(conn *sqlite3.SQLiteConn) error {
+	return conn.RegisterFunc("regexp", regexpMatch, true)
+}
+
+// likeEscaper escapes the wildcards of a LIKE pattern, with '\' as the escape character.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// tagPattern matches the hashtag '#tag' as a whole word, but not e.g. as a part of a URL or an HTML entity.
+func tagPattern(tag string) string {
+	return `(?i)(^|[^\w&/#])#` + regexp.QuoteMeta(tag) + `($|[^\w])`
+}
+
+// searchClause returns the WHERE clause selecting the posts matching 'q', along with its arguments.
+// It is empty for a zero query.
+func searchClause(q search.Query) (string, []any) {
+	conds, args := searchConds(q)
+	if len(conds) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// searchConds returns the conditions selecting the posts matching 'q', along with their arguments.
+func searchConds(q search.Query) ([]string, []any) {
+	var conds []string
+	var args []any
+	for _, t := range q.Terms {
+		conds = append(conds, `content LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(t)+"%")
+	}
+	for _, t := range q.Exclude {
+		conds = append(conds, `content NOT LIKE ? ESCAPE '\'`)
+		args = append(args, "%"+likeEscaper.Replace(t)+"%")
+	}
+	for _, t := range q.Tags {
+		conds = append(conds, "content REGEXP ?")
+		args = append(args, tagPattern(t))
+	}
+	if !q.Before.IsZero() {
+		conds = append(conds, "ts < ?")
+		args = append(args, q.Before.Unix())
+	}
+	if !q.After.IsZero() {
+		conds = append(conds, "ts >= ?")
+		args = append(args, q.After.Unix())
+	}
+	if q.HasLink {
+		conds = append(conds, "content REGEXP ?")
+		args = append(args, linkPattern)
+	}
+	if q.HasImage {
+		conds = append(conds, "content REGEXP ?")
+		args = append(args, imagePattern)
+	}
+	if q.Federated != nil {
+		// Posts which weren't federated have either no URI, or an empty one
+		if *q.Federated {
+			conds = append(conds, "length(bsky_uri) > 0")
+		} else {
+			conds = append(conds, "COALESCE(length(bsky_uri), 0) = 0")
+		}
+	}
+	return conds, args
+}
+
+// PostsPage is a page of the posts matching a query, newest first.
+type PostsPage struct {
+	Posts []Post
+	// Newer and Older are set, if there are matching posts newer or older than the ones on the page
+	Newer bool
+	Older bool
+}
+
+// whereClause joins 'conds' into a WHERE clause, which is empty without any conditions.
+func whereClause(conds []string) string {
+	if len(conds) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(conds, " AND ")
+}
+
+// GetPostsPage returns up to 'count' posts matching 'q', which were created before 'before' or after 'after'.
+// With neither set, it returns the newest posts. Unlike an offset, the cursors keep pointing at the same posts
+// when new ones are created. A page after 'after' is filled up to 'count' posts, if there aren't enough newer ones.
+func GetPostsPage(q search.Query, before, after time.Time, count int) (PostsPage, error) {
+	return postsPage(q, before, after, count, false)
+}
+
+// GetPostsPageWithURI is GetPostsPage, including the Bluesky URIs of the posts.
+func GetPostsPageWithURI(q search.Query, before, after time.Time, count int) (PostsPage, error) {
+	return postsPage(q, before, after, count, true)
+}
+
+func postsPage(q search.Query, before, after time.Time, count int, withURI bool) (PostsPage, error) {
+	cols, query := "ts,content,utc_offset", queryPosts
+	if withURI {
+		cols, query = "ts,content,utc_offset,bsky_uri", queryPostsWithURI
+	}
+	conds, args := searchConds(q)
+	// Every cursor condition is appended to a copy, not to the shared conditions
+	conds, args = slices.Clip(conds), slices.Clip(args)
+	var page PostsPage
+	var err error
+	switch {
+	case !after.IsZero():
+		// Walk towards the newer posts and turn the page around
+		page.Posts, err = query("SELECT "+cols+" FROM posts"+whereClause(append(conds, "ts > ?"))+" ORDER BY ts ASC LIMIT ?",
+			append(args, after.Unix(), count+1)...)
+		if err != nil {
+			return PostsPage{}, err
+		}
+		if len(page.Posts) <= count {
+			// This is the newest page, so it starts with the newest post, as if no cursor was set
+			return postsPage(q, time.Time{}, time.Time{}, count, withURI)
+		}
+		page.Posts = page.Posts[:count]
+		slices.Reverse(page.Posts)
+		page.Newer = true
+		page.Older, err = postsExist(append(conds, "ts <= ?"), append(args, after.Unix())...)
+	default:
+		cond, cargs := conds, args
+		if !before.IsZero() {
+			cond, cargs = append(conds, "ts < ?"), append(args, before.Unix())
+		}
+		page.Posts, err = query("SELECT "+cols+" FROM posts"+whereClause(cond)+" ORDER BY ts DESC LIMIT ?",
+			append(cargs, count+1)...)
+		if err != nil {
+			return PostsPage{}, err
+		}
+		if len(page.Posts) > count {
+			page.Posts = page.Posts[:count]
+			page.Older = true
+		}
+		if !before.IsZero() {
+			page.Newer, err = postsExist(append(conds, "ts >= ?"), append(args, before.Unix())...)
+		}
+	}
+	return page, err
+}
+
+// postsExist reports whether any posts match 'conds'.
+func postsExist(conds []string, args ...any) (bool, error) {
+	db, err := openDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var exists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM posts"+whereClause(conds)+")", args...).Scan(&exists)
+	return exists, err
+}
+
+// PostCursor returns the creation time of the post matching 'q' at 'offset' from the newest one,
+// which is the cursor equivalent of an offset. ErrNotFound is returned if there are fewer posts.
+func PostCursor(q search.Query, offset int) (time.Time, error) {
+	db, err := openDB()
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer db.Close()
+
+	where, args := searchClause(q)
+	var ts int64
+	err = db.QueryRow("SELECT ts FROM posts"+where+" ORDER BY ts DESC LIMIT 1 OFFSET ?", append(args, offset)...).Scan(&ts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrNotFound
+	}
+	return time.Unix(ts, 0).UTC(), err
+}
@@ -0,0 +1,295 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/logging"
+	"github.com/aghdom/current/site"
+)
+
+// HubPath is the path on which the built-in WebSub hub is served.
+const HubPath = "/websub"
+
+// webSubAttempts is the number of times content is delivered to a subscriber, before giving up on it.
+const webSubAttempts = 3
+
+// Subscription is a subscriber of the built-in WebSub hub to one of the feeds.
+type Subscription struct {
+	Callback string
+	Topic    string
+	// Secret signs the distributed content, if set by the subscriber
+	Secret  string
+	Expires time.Time
+}
+
+// FeedHubs returns the WebSub hubs advertised by the feeds: the ones configured in "websub.hubs",
+// followed by the built-in one, if enabled.
+func FeedHubs(cfg site.Config) []string {
+	hubs := viper.GetStringSlice("websub.hubs")
+	if viper.GetBool("websub.hub.enabled") {
+		hubs = append(hubs, cfg.URL(HubPath))
+	}
+	return hubs
+}
+
+// FeedTopic returns the feed format published as the WebSub 'topic', i.e. the URL of the feed's first page.
+func FeedTopic(cfg site.Config, topic string) (FeedFormat, bool) {
+	for _, f := range []FeedFormat{FeedAtom, FeedRSS, FeedJSON} {
+		if cfg.URL(f.Path()) == topic {
+			return f, true
+		}
+	}
+	return 0, false
+}
+
+// webSubClient returns the client for requests to the subscribers. They are only allowed on public
+// addresses, unless "websub.hub.allow_private" is set to test against local subscribers.
+func webSubClient() *http.Client {
+	timeout := viper.GetDuration("websub.timeout")
+	if viper.GetBool("websub.hub.allow_private") {
+		return &http.Client{Timeout: timeout}
+	}
+	return newSafeClient(timeout)
+}
+
+// withQuery returns 'callback' with 'params' added to its query, keeping any it already has.
+func withQuery(callback string, params url.Values) (string, error) {
+	u, err := url.Parse(callback)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// VerifyIntent confirms with the subscriber at 'callback', that it requested to 'mode' ("subscribe" or "unsubscribe")
+// to 'topic', by having it echo a random challenge.
+func VerifyIntent(ctx context.Context, callback, mode, topic string, lease time.Duration) error {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+	challenge := hex.EncodeToString(buf)
+	params := url.Values{"hub.mode": {mode}, "hub.topic": {topic}, "hub.challenge": {challenge}}
+	if mode == "subscribe" {
+		params.Set("hub.lease_seconds", strconv.Itoa(int(lease.Seconds())))
+	}
+	target, err := withQuery(callback, params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := webSubClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("verification of intent: status code %d", res.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(string(body)) != challenge {
+		return fmt.Errorf("verification of intent: challenge mismatch")
+	}
+	return nil
+}
+
+// DenySubscription informs the subscriber at 'callback', that its subscription to 'topic' was denied.
+func DenySubscription(ctx context.Context, callback, topic, reason string) error {
+	target, err := withQuery(callback, url.Values{"hub.mode": {"denied"}, "hub.topic": {topic}, "hub.reason": {reason}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	res, err := webSubClient().Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	return nil
+}
+
+// SaveSubscription creates the subscription, or renews its lease and secret if it already exists.
+func SaveSubscription(sub Subscription) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO websub_subscriptions(callback, topic, secret, expires) VALUES (?, ?, ?, ?) "+
+		"ON CONFLICT(callback, topic) DO UPDATE SET secret = excluded.secret, expires = excluded.expires",
+		sub.Callback, sub.Topic, sub.Secret, sub.Expires.Unix())
+	return err
+}
+
+// DeleteSubscription removes the subscription of 'callback' to 'topic'.
+func DeleteSubscription(callback, topic string) error {
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM websub_subscriptions WHERE callback = ? AND topic = ?", callback, topic)
+	return err
+}
+
+// Subscriptions returns the subscriptions to 'topic', whose lease hasn't expired yet.
+// Expired subscriptions are removed along the way.
+func Subscriptions(topic string) ([]Subscription, error) {
+	db, err := openDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	now := time.Now().Unix()
+	if _, err := db.Exec("DELETE FROM websub_subscriptions WHERE expires <= ?", now); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT callback, topic, secret, expires FROM websub_subscriptions WHERE topic = ? ORDER BY callback", topic)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		var expires int64
+		if err := rows.Scan(&sub.Callback, &sub.Topic, &sub.Secret, &expires); err != nil {
+			return nil, err
+		}
+		sub.Expires = time.Unix(expires, 0)
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// PingHubs notifies the hubs configured in "websub.hubs", that the feeds have changed.
+func PingHubs(ctx context.Context, cfg site.Config) {
+	client := &http.Client{Timeout: viper.GetDuration("websub.timeout")}
+	for _, hub := range viper.GetStringSlice("websub.hubs") {
+		for _, f := range []FeedFormat{FeedAtom, FeedRSS, FeedJSON} {
+			topic := cfg.URL(f.Path())
+			form := url.Values{"hub.mode": {"publish"}, "hub.url": {topic}}
+			req, err := http.NewRequestWithContext(ctx, http.MethodPost, hub, strings.NewReader(form.Encode()))
+			if err != nil {
+				slog.Error("Failed to notify WebSub hub", "hub", hub, logging.Err(err))
+				break
+			}
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			res, err := client.Do(req)
+			if err != nil {
+				slog.Error("Failed to notify WebSub hub", "hub", hub, "topic", topic, logging.Err(err))
+				continue
+			}
+			res.Body.Close()
+			if res.StatusCode < 200 || res.StatusCode > 299 {
+				slog.Error("Failed to notify WebSub hub", "hub", hub, "topic", topic, "status", res.StatusCode)
+				continue
+			}
+			slog.Debug("Notified WebSub hub", "hub", hub, "topic", topic)
+		}
+	}
+}
+
+// DistributeFeeds delivers the first page of every feed to the subscribers of the built-in hub.
+func DistributeFeeds(ctx context.Context, cfg site.Config) {
+	for _, f := range []FeedFormat{FeedAtom, FeedRSS, FeedJSON} {
+		topic := cfg.URL(f.Path())
+		subs, err := Subscriptions(topic)
+		if err != nil {
+			slog.Error("Failed to load WebSub subscriptions", "topic", topic, logging.Err(err))
+			continue
+		}
+		if len(subs) == 0 {
+			continue
+		}
+		content, err := generateFeed(cfg, f, time.Time{}, time.Time{})
+		if err != nil {
+			slog.Error("Failed to generate feed for WebSub", "topic", topic, logging.Err(err))
+			continue
+		}
+		link := fmt.Sprintf("<%s>; rel=\"hub\", <%s>; rel=\"self\"", cfg.URL(HubPath), topic)
+		for _, sub := range subs {
+			distribute(ctx, sub, f.ContentType(), link, content)
+		}
+	}
+}
+
+// distribute POSTs 'content' to the subscriber, retrying with a backoff on failures.
+// Subscribers responding with '410 Gone' are unsubscribed.
+func distribute(ctx context.Context, sub Subscription, contentType, link string, content []byte) {
+	client := webSubClient()
+	backoff := time.Second
+	for attempt := 1; attempt <= webSubAttempts; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Callback, bytes.NewReader(content))
+		if err != nil {
+			slog.Error("Failed to deliver to WebSub subscriber", "callback", sub.Callback, logging.Err(err))
+			return
+		}
+		req.Header.Set("Content-Type", contentType)
+		req.Header.Set("Link", link)
+		if sub.Secret != "" {
+			mac := hmac.New(sha256.New, []byte(sub.Secret))
+			mac.Write(content)
+			req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+		}
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			switch {
+			case res.StatusCode >= 200 && res.StatusCode <= 299:
+				slog.Debug("Delivered to WebSub subscriber", "callback", sub.Callback, "topic", sub.Topic)
+				return
+			case res.StatusCode == http.StatusGone:
+				slog.Info("Removed gone WebSub subscriber", "callback", sub.Callback, "topic", sub.Topic)
+				if err := DeleteSubscription(sub.Callback, sub.Topic); err != nil {
+					slog.Error("Failed to remove WebSub subscription", "callback", sub.Callback, logging.Err(err))
+				}
+				return
+			}
+			err = fmt.Errorf("status code %d", res.StatusCode)
+		}
+		slog.Warn("Failed to deliver to WebSub subscriber", "callback", sub.Callback, "topic", sub.Topic, "attempt", attempt, logging.Err(err))
+		if attempt == webSubAttempts {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+			backoff *= 4
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package data
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// allowLocalSubscribers configures the hub to reach the subscribers served by httptest.
+func allowLocalSubscribers(t *testing.T) {
+	t.Cleanup(viper.Reset)
+	viper.Set("websub.timeout", 5*time.Second)
+	viper.Set("websub.hub.allow_private", true)
+}
+
+// initTestDB points the config at a new DB.
+func initTestDB(t *testing.T) {
+	t.Helper()
+	allowLocalSubscribers(t)
+	viper.Set("sqlite.filepath", filepath.Join(t.TempDir(), "current.db"))
+	if err := InitDB(); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+}
+
+const testTopic = "https://example.com/current.atom"
+
+func TestVerifyIntent(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		mode    string
+		respond func(w http.ResponseWriter, challenge string)
+		wantErr bool
+	}{
+		{
+			name:    "subscribe",
+			mode:    "subscribe",
+			respond: func(w http.ResponseWriter, challenge string) { fmt.Fprint(w, challenge) },
+		},
+		{
+			name:    "unsubscribe",
+			mode:    "unsubscribe",
+			respond: func(w http.ResponseWriter, challenge string) { fmt.Fprintln(w, challenge) },
+		},
+		{
+			name:    "wrong challenge",
+			mode:    "subscribe",
+			respond: func(w http.ResponseWriter, challenge string) { fmt.Fprint(w, "not-"+challenge) },
+			wantErr: true,
+		},
+		{
+			name:    "refused",
+			mode:    "subscribe",
+			respond: func(w http.ResponseWriter, challenge string) { http.NotFound(w, nil) },
+			wantErr: true,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			allowLocalSubscribers(t)
+			var got map[string]string
+			sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				q := r.URL.Query()
+				got = map[string]string{}
+				for _, k := range []string{"hub.mode", "hub.topic", "hub.lease_seconds", "id"} {
+					got[k] = q.Get(k)
+				}
+				tc.respond(w, q.Get("hub.challenge"))
+			}))
+			t.Cleanup(sub.Close)
+
+			// The callback's own query is kept
+			err := VerifyIntent(context.Background(), sub.URL+"/callback?id=7", tc.mode, testTopic, time.Hour)
+			if gotErr := err != nil; gotErr != tc.wantErr {
+				t.Fatalf("VerifyIntent: %v, want error: %t", err, tc.wantErr)
+			}
+			want := map[string]string{"hub.mode": tc.mode, "hub.topic": testTopic, "id": "7"}
+			if tc.mode == "subscribe" {
+				want["hub.lease_seconds"] = "3600"
+			}
+			for k, v := range want {
+				if got[k] != v {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+		})
+	}
+}
+
+// subscriber is a local WebSub subscriber, which records the content delivered to it.
+type subscriber struct {
+	*httptest.Server
+	status int
+
+	mu         sync.Mutex
+	deliveries int
+	body       []byte
+	header     http.Header
+}
+
+func newSubscriber(t *testing.T, status int) *subscriber {
+	s := &subscriber{status: status}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		s.mu.Lock()
+		s.deliveries++
+		s.body, s.header = body, r.Header.Clone()
+		s.mu.Unlock()
+		w.WriteHeader(s.status)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestDistributeSignsContent(t *testing.T) {
+	for _, secret := range []string{"", "s3cret"} {
+		t.Run(fmt.Sprintf("secret %q", secret), func(t *testing.T) {
+			allowLocalSubscribers(t)
+			rec := newSubscriber(t, http.StatusNoContent)
+			content := []byte("<feed>new post</feed>")
+			sub := Subscription{Callback: rec.URL, Topic: testTopic, Secret: secret, Expires: time.Now().Add(time.Hour)}
+			distribute(context.Background(), sub, "application/atom+xml", `<https://example.com/websub>; rel="hub"`, content)
+
+			if rec.deliveries != 1 || string(rec.body) != string(content) {
+				t.Fatalf("delivered %d times with %q, want once with %q", rec.deliveries, rec.body, content)
+			}
+			if ct := rec.header.Get("Content-Type"); ct != "application/atom+xml" {
+				t.Errorf("Content-Type = %q, want the feed's", ct)
+			}
+			sig := rec.header.Get("X-Hub-Signature")
+			if secret == "" {
+				if sig != "" {
+					t.Errorf("X-Hub-Signature = %q without a secret, want none", sig)
+				}
+				return
+			}
+			algo, digest, _ := strings.Cut(sig, "=")
+			mac := hmac.New(sha256.New, []byte(secret))
+			mac.Write(content)
+			if want := hex.EncodeToString(mac.Sum(nil)); algo != "sha256" || digest != want {
+				t.Errorf("X-Hub-Signature = %q, want sha256=%s", sig, want)
+			}
+		})
+	}
+}
+
+func TestDistributeRemovesGoneSubscriber(t *testing.T) {
+	initTestDB(t)
+	gone := newSubscriber(t, http.StatusGone)
+	kept := newSubscriber(t, http.StatusOK)
+	for _, callback := range []string{gone.URL, kept.URL} {
+		if err := SaveSubscription(Subscription{Callback: callback, Topic: testTopic, Expires: time.Now().Add(time.Hour)}); err != nil {
+			t.Fatalf("SaveSubscription: %v", err)
+		}
+	}
+
+	subs, err := Subscriptions(testTopic)
+	if err != nil {
+		t.Fatalf("Subscriptions: %v", err)
+	}
+	for _, sub := range subs {
+		distribute(context.Background(), sub, "application/atom+xml", "", []byte("<feed/>"))
+	}
+
+	if gone.deliveries != 1 {
+		t.Errorf("delivered %d times to the gone subscriber, want 1 without retries", gone.deliveries)
+	}
+	subs, err = Subscriptions(testTopic)
+	if err != nil {
+		t.Fatalf("Subscriptions: %v", err)
+	}
+	if len(subs) != 1 || subs[0].Callback != kept.URL {
+		t.Errorf("subscriptions after delivery = %+v, want only %s", subs, kept.URL)
+	}
+}
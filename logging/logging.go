@@ -0,0 +1,108 @@
+// Package logging configures the structured logger shared by the application.
+package logging
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// Keys of the attributes shared across log records, so they can be filtered on consistently.
+const (
+	KeyRequestID = "request_id"
+	KeyPost      = "post"
+	KeyBskyURI   = "bsky_uri"
+	KeyError     = "error"
+)
+
+// Post identifies a post by its timestamp, the same as in its permalink.
+func Post(t time.Time) slog.Attr {
+	return slog.Int64(KeyPost, t.Unix())
+}
+
+// BskyURI identifies the federated copy of a post.
+func BskyURI(uri string) slog.Attr {
+	return slog.String(KeyBskyURI, uri)
+}
+
+// Err adds 'err' to a record.
+func Err(err error) slog.Attr {
+	return slog.Any(KeyError, err)
+}
+
+const redacted = "[REDACTED]"
+
+// secretKeys matches attribute keys, whose values are never logged.
+var secretKeys = regexp.MustCompile(`(?i)pass|secret|token|jwt|authorization|cookie`)
+
+// secretValues matches credentials embedded in logged strings, i.e. bearer tokens and JWTs.
+var secretValues = regexp.MustCompile(`(?i)(bearer\s+)[\w.~+/=-]+|eyJ[\w-]+\.[\w-]+\.[\w-]*`)
+
+func scrub(s string) string {
+	return secretValues.ReplaceAllStringFunc(s, func(m string) string {
+		if loc := secretValues.FindStringSubmatchIndex(m); loc[2] >= 0 {
+			return m[:loc[3]] + redacted
+		}
+		return redacted
+	})
+}
+
+// redact replaces the values of secret attributes and scrubs credentials from all the others.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKeys.MatchString(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		a.Value = slog.StringValue(scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			a.Value = slog.StringValue(scrub(err.Error()))
+		}
+	}
+	return a
+}
+
+// Configure sets up the default logger as configured in the "log" section:
+// "log.level" (debug, info, warn or error), "log.format" (text or json) and
+// "log.output" (stderr, stdout or the path of a file to append to).
+// Records of the standard "log" package are routed through it as well.
+func Configure() error {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(viper.GetString("log.level"))); err != nil {
+		return fmt.Errorf("log.level: %w", err)
+	}
+
+	var out io.Writer
+	switch dest := viper.GetString("log.output"); dest {
+	case "", "stderr":
+		out = os.Stderr
+	case "stdout":
+		out = os.Stdout
+	default:
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("log.output: %w", err)
+		}
+		out = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	var h slog.Handler
+	switch format := strings.ToLower(viper.GetString("log.format")); format {
+	case "", "text":
+		h = slog.NewTextHandler(out, opts)
+	case "json":
+		h = slog.NewJSONHandler(out, opts)
+	default:
+		return fmt.Errorf("log.format: unknown format %q, expected text or json", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
@@ -0,0 +1,77 @@
+// Package metrics holds the Prometheus collectors of the application.
+package metrics
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Registry holds all the collectors exposed by Handler.
+var Registry = prometheus.NewRegistry()
+
+var factory = promauto.With(Registry)
+
+var (
+	HTTPRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "current_http_requests_total",
+		Help: "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+	HTTPDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "current_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by route pattern and method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method"})
+
+	DBQueryDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "current_db_query_duration_seconds",
+		Help:    "Duration of DB statements by operation.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"op"})
+	DBErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "current_db_errors_total",
+		Help: "Failed DB statements by operation.",
+	}, []string{"op"})
+
+	BskyRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "current_bsky_requests_total",
+		Help: "Bluesky XRPC calls by method and outcome (success, error or failure to connect).",
+	}, []string{"method", "outcome"})
+	BskyDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "current_bsky_request_duration_seconds",
+		Help:    "Latency of Bluesky XRPC calls by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+)
+
+func init() {
+	Registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+}
+
+// ObserveQuery records the duration and outcome of a DB statement.
+// The operation is the statement's leading keyword, e.g. "select" or "insert".
+func ObserveQuery(query string, start time.Time, err error) {
+	op := "other"
+	if fields := strings.Fields(query); len(fields) > 0 {
+		op = strings.ToLower(fields[0])
+	}
+	DBQueryDuration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		DBErrors.WithLabelValues(op).Inc()
+	}
+}
+
+// Gauge registers a gauge, whose value is computed by 'fn' on every scrape.
+func Gauge(name, help string, fn func() float64) {
+	factory.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, fn)
+}
+
+// Handler serves the collected metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
@@ -0,0 +1,114 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gomarkdown/markdown/ast"
+)
+
+// Highlight configures the syntax highlighting of fenced code blocks.
+type Highlight struct {
+	Enabled bool
+	// LineNumbers shows line numbers on all code blocks, unless a block opts out with "nolinenos"
+	LineNumbers bool
+	// InlineStyle is the chroma style used for inline styles. If empty, CSS classes are emitted instead.
+	InlineStyle string
+}
+
+// codeInfo is the parsed info string of a fenced code block. The short form "go{1,3-4}" only highlights
+// the given lines, while the long form "{go linenos hl=1,3-4}" also allows to toggle the line numbers.
+type codeInfo struct {
+	lang        string
+	lineNumbers *bool
+	highlighted [][2]int
+}
+
+func parseCodeInfo(info string) codeInfo {
+	var ci codeInfo
+	for n, field := range strings.Fields(info) {
+		switch {
+		case n == 0:
+			lang, ranges, ok := strings.Cut(strings.TrimPrefix(field, "."), "{")
+			ci.lang = lang
+			if ok {
+				ci.highlighted = parseRanges(strings.TrimSuffix(ranges, "}"))
+			}
+		case field == "linenos":
+			on := true
+			ci.lineNumbers = &on
+		case field == "nolinenos":
+			off := false
+			ci.lineNumbers = &off
+		case strings.HasPrefix(field, "hl="):
+			ci.highlighted = parseRanges(strings.TrimPrefix(field, "hl="))
+		}
+	}
+	return ci
+}
+
+// parseRanges parses comma-separated line numbers and ranges, like "1,3-4". Invalid parts are skipped.
+func parseRanges(s string) [][2]int {
+	var ranges [][2]int
+	for _, part := range strings.Split(s, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			continue
+		}
+		end := start
+		if isRange {
+			if end, err = strconv.Atoi(strings.TrimSpace(to)); err != nil || end < start {
+				continue
+			}
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges
+}
+
+// renderCode is a render hook of the HTML renderer, which highlights fenced code blocks with a known language.
+// Other nodes and code blocks are left to the default rendering.
+func (h Highlight) renderCode(w io.Writer, node ast.Node, entering bool) (ast.WalkStatus, bool) {
+	cb, ok := node.(*ast.CodeBlock)
+	if !ok || !h.Enabled || len(cb.Info) == 0 {
+		return ast.GoToNext, false
+	}
+	ci := parseCodeInfo(string(cb.Info))
+	lexer := lexers.Get(ci.lang)
+	if lexer == nil {
+		return ast.GoToNext, false
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(cb.Literal))
+	if err != nil {
+		return ast.GoToNext, false
+	}
+
+	lineNumbers := h.LineNumbers
+	if ci.lineNumbers != nil {
+		lineNumbers = *ci.lineNumbers
+	}
+	style := styles.Get(h.InlineStyle)
+	formatter := chromahtml.New(
+		chromahtml.WithClasses(h.InlineStyle == ""),
+		chromahtml.WithLineNumbers(lineNumbers),
+		chromahtml.LineNumbersInTable(lineNumbers),
+		chromahtml.HighlightLines(ci.highlighted),
+	)
+	// The block is formatted aside, so a failure doesn't leave half of it in the output
+	var buf bytes.Buffer
+	if err := formatter.Format(&buf, style, iterator); err != nil {
+		fmt.Fprintf(w, "<pre><code>%s</code></pre>", html.EscapeString(string(cb.Literal)))
+		return ast.GoToNext, true
+	}
+	w.Write(buf.Bytes())
+	return ast.GoToNext, true
+}
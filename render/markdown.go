@@ -0,0 +1,263 @@
+package render
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gomarkdown/markdown"
+	"github.com/gomarkdown/markdown/html"
+	"github.com/gomarkdown/markdown/parser"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/spf13/viper"
+	nethtml "golang.org/x/net/html"
+)
+
+// extensions maps the names used in the "markdown.extensions" config onto the parser extensions.
+var extensions = map[string]parser.Extensions{
+	"tables":            parser.Tables,
+	"fenced_code":       parser.FencedCode,
+	"autolinks":         parser.Autolink,
+	"strikethrough":     parser.Strikethrough,
+	"footnotes":         parser.Footnotes,
+	"no_intra_emphasis": parser.NoIntraEmphasis,
+	"space_headings":    parser.SpaceHeadings,
+	"heading_ids":       parser.HeadingIDs,
+	"auto_heading_ids":  parser.AutoHeadingIDs,
+	"hard_line_breaks":  parser.HardLineBreak,
+	"backslash_breaks":  parser.BackslashLineBreak,
+	"definition_lists":  parser.DefinitionLists,
+	"superscript":       parser.SuperSubscript,
+	"mathjax":           parser.MathJax,
+}
+
+// DefaultExtensions are the extensions enabled, unless configured otherwise.
+var DefaultExtensions = []string{
+	"tables", "fenced_code", "autolinks", "strikethrough", "footnotes",
+	"no_intra_emphasis", "space_headings", "backslash_breaks", "definition_lists",
+}
+
+// Renderer turns markdown into sanitised HTML.
+type Renderer struct {
+	extensions parser.Extensions
+	flags      html.Flags
+	policy     *bluemonday.Policy
+	highlight  Highlight
+}
+
+// New creates a Renderer with the named parser extensions and syntax highlighting of code blocks.
+func New(exts []string, hl Highlight) (*Renderer, error) {
+	r := &Renderer{
+		flags:     html.CommonFlags | html.FootnoteReturnLinks,
+		policy:    newPolicy(),
+		highlight: hl,
+	}
+	for _, name := range exts {
+		ext, ok := extensions[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, fmt.Errorf("unknown markdown extension %q, available: %s", name, strings.Join(available(), ", "))
+		}
+		r.extensions |= ext
+	}
+	return r, nil
+}
+
+func available() []string {
+	names := make([]string, 0, len(extensions))
+	for name := range extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newPolicy returns the allowlist of elements and attributes, which may appear in rendered posts.
+// Anything else, e.g. scripts, styles or event handlers in raw HTML, is stripped.
+func newPolicy() *bluemonday.Policy {
+	p := bluemonday.UGCPolicy()
+	// The "rel" attribute of links is set by decorate instead
+	p.RequireNoFollowOnLinks(false)
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(footnote-return|footnote-ref)$`)).OnElements("a", "sup")
+	// Highlighted code blocks with line numbers are wrapped in a "chroma" div
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^(footnotes|chroma)$`)).OnElements("div")
+	// Highlighted code blocks use either chroma's classes, or inline styles in the feeds
+	p.AllowAttrs("class").Matching(regexp.MustCompile(`^[a-zA-Z0-9 _-]+$`)).OnElements("pre", "code", "span", "table", "tr", "td")
+	p.AllowStyles("color", "background-color", "font-weight", "font-style", "text-decoration",
+		"display", "width", "padding", "margin", "margin-right", "border-spacing", "overflow", "tab-size",
+		"white-space", "user-select", "-webkit-user-select", "vertical-align").OnElements("pre", "code", "span", "table", "tr", "td")
+	p.AllowElements("table", "tr", "td")
+	return p
+}
+
+// Render renders the markdown in 'md' into sanitised HTML.
+func (r *Renderer) Render(md []byte) []byte {
+	md = markdown.NormalizeNewlines(md)
+	p := parser.NewWithExtensions(r.extensions)
+	renderer := html.NewRenderer(html.RendererOptions{Flags: r.flags, RenderNodeHook: r.highlight.renderCode})
+	return decorate(r.policy.SanitizeBytes(markdown.ToHTML(md, p, renderer)))
+}
+
+// decorate adds rel="nofollow noopener" to external links and makes images load lazily.
+// It runs on the sanitised HTML, so it covers raw HTML in posts just as well as the rendered markdown.
+func decorate(b []byte) []byte {
+	var out bytes.Buffer
+	z := nethtml.NewTokenizer(bytes.NewReader(b))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			break
+		}
+		if tt != nethtml.StartTagToken && tt != nethtml.SelfClosingTagToken {
+			out.Write(z.Raw())
+			continue
+		}
+		t := z.Token()
+		switch t.Data {
+		case "a":
+			if isExternal(attr(t, "href")) {
+				setAttr(&t, "rel", "nofollow noopener")
+			}
+		case "img":
+			setAttr(&t, "loading", "lazy")
+		}
+		out.WriteString(t.String())
+	}
+	return out.Bytes()
+}
+
+func isExternal(href string) bool {
+	u, err := url.Parse(href)
+	return err == nil && u.Host != ""
+}
+
+// FirstExternalLink returns the target of the first external http(s) link in the markdown 'md',
+// or an empty string if there is none.
+func FirstExternalLink(md []byte) string {
+	z := nethtml.NewTokenizer(bytes.NewReader(Markdown(md)))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			return ""
+		}
+		if tt != nethtml.StartTagToken {
+			continue
+		}
+		t := z.Token()
+		if t.Data != "a" {
+			continue
+		}
+		if u, err := url.Parse(attr(t, "href")); err == nil && u.Host != "" && (u.Scheme == "http" || u.Scheme == "https") {
+			return u.String()
+		}
+	}
+}
+
+// Mark wraps the occurrences of 'terms' in the text of the HTML 'b' into <mark> elements, ignoring case.
+// Terms are only matched within a single text node, so e.g. a phrase spanning emphasis isn't marked.
+func Mark(b []byte, terms []string) []byte {
+	if len(terms) == 0 {
+		return b
+	}
+	// Prefer the longest of overlapping terms
+	sorted := append([]string(nil), terms...)
+	sort.Slice(sorted, func(i, j int) bool { return len(sorted[i]) > len(sorted[j]) })
+	for i, t := range sorted {
+		sorted[i] = regexp.QuoteMeta(t)
+	}
+	re := regexp.MustCompile("(?i)" + strings.Join(sorted, "|"))
+
+	var out bytes.Buffer
+	z := nethtml.NewTokenizer(bytes.NewReader(b))
+	for {
+		tt := z.Next()
+		if tt == nethtml.ErrorToken {
+			break
+		}
+		if tt != nethtml.TextToken {
+			out.Write(z.Raw())
+			continue
+		}
+		text := string(z.Text())
+		last := 0
+		for _, m := range re.FindAllStringIndex(text, -1) {
+			out.WriteString(nethtml.EscapeString(text[last:m[0]]))
+			out.WriteString("<mark>" + nethtml.EscapeString(text[m[0]:m[1]]) + "</mark>")
+			last = m[1]
+		}
+		out.WriteString(nethtml.EscapeString(text[last:]))
+	}
+	return out.Bytes()
+}
+
+func attr(t nethtml.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+func setAttr(t *nethtml.Token, key, val string) {
+	for i, a := range t.Attr {
+		if a.Key == key {
+			t.Attr[i].Val = val
+			return
+		}
+	}
+	t.Attr = append(t.Attr, nethtml.Attribute{Key: key, Val: val})
+}
+
+var (
+	current atomic.Pointer[Renderer]
+	feed    atomic.Pointer[Renderer]
+)
+
+// Configure sets up the shared renderers from the "markdown" config section.
+func Configure() error {
+	exts := DefaultExtensions
+	if viper.IsSet("markdown.extensions") {
+		exts = viper.GetStringSlice("markdown.extensions")
+	}
+	hl := Highlight{
+		Enabled:     viper.GetBool("markdown.highlight.enabled"),
+		LineNumbers: viper.GetBool("markdown.highlight.line_numbers"),
+	}
+	r, err := New(exts, hl)
+	if err != nil {
+		return err
+	}
+	// Feed readers don't load the site's stylesheets, so the feeds get inline styles
+	hl.InlineStyle = viper.GetString("markdown.highlight.feed_style")
+	fr, err := New(exts, hl)
+	if err != nil {
+		return err
+	}
+	current.Store(r)
+	feed.Store(fr)
+	return nil
+}
+
+func load(p *atomic.Pointer[Renderer], hl Highlight) *Renderer {
+	r := p.Load()
+	if r == nil {
+		// Not configured yet, fall back to the defaults
+		r, _ = New(DefaultExtensions, hl)
+		p.CompareAndSwap(nil, r)
+	}
+	return r
+}
+
+// Markdown renders 'md' with the shared renderer of the site.
+func Markdown(md []byte) []byte {
+	return load(&current, Highlight{Enabled: true}).Render(md)
+}
+
+// FeedMarkdown renders 'md' for the feeds, where code blocks are highlighted with inline styles.
+func FeedMarkdown(md []byte) []byte {
+	return load(&feed, Highlight{Enabled: true, InlineStyle: "github"}).Render(md)
+}
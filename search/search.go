@@ -0,0 +1,164 @@
+// Package search parses the query language of the post search.
+//
+// A query is a list of space-separated words, all of which must appear in a post. Words can be grouped
+// into "quoted phrases" and excluded by a leading '-'. The operators 'tag:x', 'before:YYYY-MM-DD',
+// 'after:YYYY-MM-DD', 'has:link', 'has:image' and 'federated:yes|no' filter the posts further.
+package search
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Query is a parsed search query.
+type Query struct {
+	// Raw is the query as entered
+	Raw string
+	// Terms are the words and phrases, all of which must appear in a post
+	Terms []string
+	// Exclude are the words and phrases, none of which may appear in a post
+	Exclude []string
+	// Tags are the hashtags, without the '#', all of which must appear in a post
+	Tags []string
+	// Before and After bound the creation time of the posts, they are zero if unset
+	Before time.Time
+	After  time.Time
+	// HasLink and HasImage require a post to contain a link or an image
+	HasLink  bool
+	HasImage bool
+	// Federated requires a post to be federated to Bluesky, or not to be, if set
+	Federated *bool
+}
+
+// IsZero reports whether the query matches all the posts.
+func (q Query) IsZero() bool {
+	return len(q.Terms) == 0 && len(q.Exclude) == 0 && len(q.Tags) == 0 && q.Before.IsZero() && q.After.IsZero() &&
+		!q.HasLink && !q.HasImage && q.Federated == nil
+}
+
+// dateLayouts are the accepted formats of the dates in 'before:' and 'after:'.
+var dateLayouts = []string{"2006-01-02", "2006/01/02"}
+
+func parseDate(op, value string, loc *time.Location) (time.Time, error) {
+	for _, layout := range dateLayouts {
+		if tm, err := time.ParseInLocation(layout, value, loc); err == nil {
+			return tm, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%s: expects a date like 2006-01-02, not %q", op, value)
+}
+
+// Parse parses the query 'raw'. The dates of 'before:' and 'after:' are days in 'loc', both exclusive.
+// Unknown operators are searched for as plain words.
+func Parse(raw string, loc *time.Location) (Query, error) {
+	q := Query{Raw: strings.TrimSpace(raw)}
+	for _, tok := range tokenize(q.Raw) {
+		if tok.quoted {
+			if tok.negated {
+				q.Exclude = append(q.Exclude, tok.text)
+			} else {
+				q.Terms = append(q.Terms, tok.text)
+			}
+			continue
+		}
+		op, value, _ := strings.Cut(tok.text, ":")
+		switch op = strings.ToLower(op); {
+		case tok.negated || value == "":
+		case op == "tag":
+			q.Tags = append(q.Tags, strings.TrimPrefix(value, "#"))
+			continue
+		case op == "before":
+			tm, err := parseDate(op, value, loc)
+			if err != nil {
+				return Query{}, err
+			}
+			q.Before = tm
+			continue
+		case op == "after":
+			tm, err := parseDate(op, value, loc)
+			if err != nil {
+				return Query{}, err
+			}
+			q.After = tm.AddDate(0, 0, 1)
+			continue
+		case op == "has":
+			switch strings.ToLower(value) {
+			case "link":
+				q.HasLink = true
+			case "image":
+				q.HasImage = true
+			default:
+				return Query{}, fmt.Errorf("has: expects link or image, not %q", value)
+			}
+			continue
+		case op == "federated":
+			var fed bool
+			switch strings.ToLower(value) {
+			case "yes":
+				fed = true
+			case "no":
+			default:
+				return Query{}, fmt.Errorf("federated: expects yes or no, not %q", value)
+			}
+			q.Federated = &fed
+			continue
+		}
+		if tok.negated {
+			q.Exclude = append(q.Exclude, tok.text)
+		} else {
+			q.Terms = append(q.Terms, tok.text)
+		}
+	}
+	return q, nil
+}
+
+type token struct {
+	text    string
+	quoted  bool
+	negated bool
+}
+
+// tokenize splits 'raw' into words and quoted phrases. An unterminated quote runs until the end of the query.
+func tokenize(raw string) []token {
+	var tokens []token
+	rs := []rune(raw)
+	for i := 0; i < len(rs); {
+		if unicode.IsSpace(rs[i]) {
+			i++
+			continue
+		}
+		var tok token
+		if rs[i] == '-' && i+1 < len(rs) && !unicode.IsSpace(rs[i+1]) {
+			tok.negated = true
+			i++
+		}
+		start := i
+		if rs[i] == '"' {
+			tok.quoted = true
+			start = i + 1
+			for i = start; i < len(rs) && rs[i] != '"'; i++ {
+			}
+			tok.text = string(rs[start:i])
+			i++
+		} else {
+			for ; i < len(rs) && !unicode.IsSpace(rs[i]); i++ {
+			}
+			tok.text = string(rs[start:i])
+		}
+		if tok.text = strings.TrimSpace(tok.text); tok.text != "" {
+			tokens = append(tokens, tok)
+		}
+	}
+	return tokens
+}
+
+// Highlights returns the words, phrases and hashtags to highlight in the matching posts.
+func (q Query) Highlights() []string {
+	hl := append([]string(nil), q.Terms...)
+	for _, tag := range q.Tags {
+		hl = append(hl, "#"+tag)
+	}
+	return hl
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/aghdom/current/data"
+)
+
+// NavLink is a link to a neighbouring period of an archive page.
+type NavLink struct {
+	URL   string
+	Label string
+}
+
+// period is a range of time browsable on an archive page.
+type period struct {
+	From, To time.Time
+	// Step is the offset between neighbouring periods, as years, months and days
+	Step [3]int
+	// Format is the layout used both for the title and the URL of the period
+	Format string
+}
+
+func (p period) shift(n int) period {
+	return period{
+		From:   p.From.AddDate(n*p.Step[0], n*p.Step[1], n*p.Step[2]),
+		To:     p.To.AddDate(n*p.Step[0], n*p.Step[1], n*p.Step[2]),
+		Step:   p.Step,
+		Format: p.Format,
+	}
+}
+
+func (p period) link() *NavLink {
+	return &NavLink{URL: "/on/" + p.From.Format(p.Format), Label: p.From.Format(p.Format)}
+}
+
+// renderPeriod renders the posts in 'p', with links to the neighbouring periods, as long as they contain any posts.
+func (s *server) renderPeriod(w http.ResponseWriter, r *http.Request, p period) {
+	posts, err := data.GetPostsBetween(p.From, p.To)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	first, last, err := data.PostTimeRange()
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	pd := PageData{
+		Title: "Posts on " + p.From.Format(p.Format),
+	}
+	if !first.IsZero() && first.Before(p.From) {
+		pd.Prev = p.shift(-1).link()
+	}
+	if !last.IsZero() && !last.Before(p.To) {
+		pd.Next = p.shift(1).link()
+	}
+	for _, post := range posts {
+		pd.Feed = append(pd.Feed, s.transformPost(post))
+	}
+	s.render(w, r, http.StatusOK, "index", pd)
+}
+
+func (s *server) handleOnYear(w http.ResponseWriter, r *http.Request) {
+	tm, err := time.ParseInLocation("2006", chi.URLParam(r, "year"), s.site.Location)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	s.renderPeriod(w, r, period{From: tm, To: tm.AddDate(1, 0, 0), Step: [3]int{1, 0, 0}, Format: "2006"})
+}
+
+func (s *server) handleOnMonth(w http.ResponseWriter, r *http.Request) {
+	tm, err := time.ParseInLocation("2006/1", chi.URLParam(r, "year")+"/"+chi.URLParam(r, "month"), s.site.Location)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	s.renderPeriod(w, r, period{From: tm, To: tm.AddDate(0, 1, 0), Step: [3]int{0, 1, 0}, Format: "2006/01"})
+}
+
+func (s *server) handleOnDate(w http.ResponseWriter, r *http.Request) {
+	tm, err := parseDate(chi.URLParam(r, "year"), chi.URLParam(r, "month"), chi.URLParam(r, "day"), s.site.Location)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	s.renderPeriod(w, r, period{From: tm, To: tm.AddDate(0, 0, 1), Step: [3]int{0, 0, 1}, Format: "2006/01/02"})
+}
+
+// ArchiveDay is a single cell of the posting heatmap.
+type ArchiveDay struct {
+	// Date is empty for the padding cells before the first day of the year
+	Date  string
+	Count int
+	// Level is the intensity of the cell, from 0 (no posts) to 4
+	Level int
+}
+
+type ArchiveMonth struct {
+	Name  string
+	URL   string
+	Count int
+}
+
+type ArchiveYear struct {
+	Year   int
+	Count  int
+	Months []ArchiveMonth
+	Days   []ArchiveDay
+}
+
+type ArchiveData struct {
+	Title string
+	Total int
+	Years []ArchiveYear
+}
+
+// heatLevel maps 'count' onto one of the 5 heatmap levels, relative to the busiest day.
+func heatLevel(count, max int) int {
+	if count == 0 || max == 0 {
+		return 0
+	}
+	return (count*4 + max - 1) / max
+}
+
+// buildArchive groups the per-day post counts into years and months, newest year first.
+func buildArchive(counts []data.DayCount) ArchiveData {
+	ad := ArchiveData{Title: "Archive"}
+	if len(counts) == 0 {
+		return ad
+	}
+
+	max := 0
+	perDay := map[time.Time]int{}
+	for _, dc := range counts {
+		perDay[dc.Day] = dc.Count
+		if dc.Count > max {
+			max = dc.Count
+		}
+	}
+
+	for year := counts[len(counts)-1].Day.Year(); year >= counts[0].Day.Year(); year-- {
+		ay := ArchiveYear{Year: year}
+		for m := time.January; m <= time.December; m++ {
+			ay.Months = append(ay.Months, ArchiveMonth{
+				Name: m.String()[:3],
+				URL:  fmt.Sprintf("/on/%d/%02d", year, m),
+			})
+		}
+
+		start := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+		// Pad the first week, so that every row of the heatmap is a single weekday
+		for i := 0; i < int(start.Weekday()); i++ {
+			ay.Days = append(ay.Days, ArchiveDay{})
+		}
+		for d := start; d.Year() == year; d = d.AddDate(0, 0, 1) {
+			c := perDay[d]
+			ay.Count += c
+			ay.Months[d.Month()-1].Count += c
+			ay.Days = append(ay.Days, ArchiveDay{
+				Date:  d.Format("2006/01/02"),
+				Count: c,
+				Level: heatLevel(c, max),
+			})
+		}
+		ad.Total += ay.Count
+		ad.Years = append(ad.Years, ay)
+	}
+	return ad
+}
+
+func (s *server) handleArchive(w http.ResponseWriter, r *http.Request) {
+	counts, err := data.CountPostsPerDay(s.site.Location)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	s.render(w, r, http.StatusOK, "archive", buildArchive(counts))
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// assets serves static files under content-hashed ("fingerprinted") names,
+// which allows them to be cached indefinitely by browsers.
+type assets struct {
+	fsys      fs.FS
+	handler   http.Handler
+	hashed    map[string]string // original name -> fingerprinted name
+	originals map[string]string // fingerprinted name -> original name
+}
+
+func newAssets(fsys fs.FS) (*assets, error) {
+	a := &assets{
+		fsys:      fsys,
+		handler:   http.FileServer(http.FS(fsys)),
+		hashed:    map[string]string{},
+		originals: map[string]string{},
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		ext := path.Ext(name)
+		fp := strings.TrimSuffix(name, ext) + "." + hex.EncodeToString(sum[:])[:12] + ext
+		a.hashed[name] = fp
+		a.originals[fp] = name
+		return nil
+	})
+	return a, err
+}
+
+// URL returns the public URL of the static file 'name', fingerprinted if the file is known.
+// Absolute URLs are returned unchanged.
+func (a *assets) URL(name string) string {
+	if strings.Contains(name, "://") {
+		return name
+	}
+	name = strings.TrimPrefix(name, "/")
+	if fp, ok := a.hashed[name]; ok {
+		return "/s/" + fp
+	}
+	return "/s/" + name
+}
+
+// ServeHTTP serves a static file, expecting the "/s/" prefix to already be stripped.
+// Fingerprinted names are served as immutable, plain names only get a short-lived cache.
+func (a *assets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if orig, ok := a.originals[r.URL.Path]; ok {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		r.URL.Path = orig
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	a.handler.ServeHTTP(w, r)
+}
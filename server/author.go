@@ -0,0 +1,364 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/render"
+	"github.com/aghdom/current/search"
+)
+
+// authorPageSize is the number of posts listed per page of the dashboard.
+const authorPageSize = 20
+
+// AuthorPost is a row of the dashboard's post list.
+type AuthorPost struct {
+	FeedPost
+	// Markdown is the source of the post, for editing
+	Markdown string
+	BskyURI  string
+	// BskyURL links to the federated copy on the Bluesky web app
+	BskyURL string
+	// Job is the latest unfinished federation job of the post
+	Job *AuthorJob
+}
+
+// AuthorJob is a row of the dashboard's federation outbox.
+type AuthorJob struct {
+	ID    int64
+	Kind  data.OutboxKind
+	State data.OutboxState
+	// Unix, Date and Time are the creation time of the post
+	Unix     int64
+	Date     string
+	Time     string
+	Attempts int
+	// Next is the time of the next attempt of a pending job
+	Next  string
+	Error string
+}
+
+// AuthorData is passed to the dashboard templates.
+type AuthorData struct {
+	Query string
+	Posts []AuthorPost
+	// Newer and Older link to the neighbouring pages of the post list
+	Newer string
+	Older string
+	// Return is the dashboard URL to go back to after an action
+	Return string
+	// Edit is the post open in the editor
+	Edit *AuthorPost
+	// Outbox lists the federation jobs, which are pending or failed for good
+	Outbox []AuthorJob
+	// Dead is the number of jobs in Outbox, which failed for good
+	Dead int
+}
+
+func (s *server) toAuthorJob(j data.OutboxJob) AuthorJob {
+	tm := j.Post.In(s.site.Location)
+	aj := AuthorJob{
+		ID:       j.ID,
+		Kind:     j.Kind,
+		State:    j.State,
+		Unix:     j.Post.Unix(),
+		Date:     tm.Format("2006/01/02"),
+		Time:     tm.Format("15:04"),
+		Attempts: j.Attempts,
+		Error:    j.LastError,
+	}
+	if j.State == data.OutboxPending {
+		aj.Next = j.NextAttempt.In(s.site.Location).Format("2006/01/02 15:04:05")
+	}
+	return aj
+}
+
+func (s *server) toAuthorPost(p data.Post) AuthorPost {
+	return AuthorPost{
+		FeedPost: s.transformPost(p),
+		Markdown: string(p.Content),
+		BskyURI:  string(p.BskyURI),
+		BskyURL:  data.BskyPostURL(string(p.BskyURI)),
+	}
+}
+
+func (s *server) handleAuthor(w http.ResponseWriter, r *http.Request) {
+	ad := AuthorData{Query: r.URL.Query().Get("q")}
+	q, err := search.Parse(ad.Query, s.site.Location)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	if r.URL.Query().Has("p") {
+		s.redirectPage(w, r, q, "/author", "p", authorPageSize)
+		return
+	}
+	before, err := parseCursor(r, "before")
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	after, err := parseCursor(r, "after")
+	if err != nil || (!before.IsZero() && !after.IsZero()) {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	switch {
+	case !before.IsZero():
+		ad.Return = cursorURL("/author", q.Raw, "before", before)
+	case !after.IsZero():
+		ad.Return = cursorURL("/author", q.Raw, "after", after)
+	default:
+		ad.Return = cursorURL("/author", q.Raw, "", time.Time{})
+	}
+
+	page, err := data.GetPostsPageWithURI(q, before, after, authorPageSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(page.Posts) > 0 {
+		if page.Newer {
+			ad.Newer = cursorURL("/author", q.Raw, "after", page.Posts[0].Time)
+		}
+		if page.Older {
+			ad.Older = cursorURL("/author", q.Raw, "before", page.Posts[len(page.Posts)-1].Time)
+		}
+	} else if !before.IsZero() || !after.IsZero() {
+		ad.Newer = cursorURL("/author", q.Raw, "", time.Time{})
+	}
+	jobs, err := data.UnfinishedOutboxJobs()
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	postJobs := map[int64]*AuthorJob{}
+	for _, j := range jobs {
+		ad.Outbox = append(ad.Outbox, s.toAuthorJob(j))
+		if j.State == data.OutboxDead {
+			ad.Dead++
+		}
+	}
+	// Jobs are oldest first, so the latest job of each post wins
+	for i, aj := range ad.Outbox {
+		if aj.Kind == data.OutboxCreate {
+			postJobs[aj.Unix] = &ad.Outbox[i]
+		}
+	}
+	highlights := q.Highlights()
+	for _, p := range page.Posts {
+		ap := s.toAuthorPost(p)
+		ap.Content = template.HTML(render.Mark([]byte(ap.Content), highlights))
+		ap.Job = postJobs[ap.Unix]
+		ad.Posts = append(ad.Posts, ap)
+	}
+	s.render(w, r, http.StatusOK, "author", ad)
+}
+
+// redirectBack sends the browser back to the dashboard page the action was submitted from.
+func redirectBack(w http.ResponseWriter, r *http.Request) {
+	target := r.FormValue("return")
+	// Only dashboard URLs are accepted, so the parameter can't be abused for open redirects
+	if target != "/author" && !strings.HasPrefix(target, "/author?") {
+		target = "/author"
+	}
+	w.Header().Add("Location", target)
+	w.WriteHeader(http.StatusSeeOther)
+}
+
+// formTimes parses the post timestamps submitted as "time", one per selected post.
+func formTimes(r *http.Request) ([]time.Time, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var times []time.Time
+	for _, v := range r.PostForm["time"] {
+		ts, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, time.Unix(ts, 0).UTC())
+	}
+	if len(times) == 0 {
+		return nil, errors.New("no posts selected")
+	}
+	return times, nil
+}
+
+// maxUTCOffset bounds the UTC offsets in use, which range from -12:00 to +14:00.
+const maxUTCOffset = 14 * 60 * 60
+
+// authorOffset returns the author's UTC offset in seconds, as reported by the composer.
+// Without it, e.g. when scripts are disabled, the current offset of the site's timezone is assumed.
+func (s *server) authorOffset(r *http.Request) (int, error) {
+	if v := r.FormValue("utc_offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < -maxUTCOffset || offset > maxUTCOffset {
+			return 0, fmt.Errorf("invalid UTC offset %q", v)
+		}
+		return offset, nil
+	}
+	_, offset := time.Now().In(s.site.Location).Zone()
+	return offset, nil
+}
+
+func (s *server) handleAuthorPost(w http.ResponseWriter, r *http.Request) {
+	bskyFed := r.FormValue("bsky_fed") == "on"
+	offset, err := s.authorOffset(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, err)
+		return
+	}
+	// Should empty content be allowed?
+	if err := data.CreatePost(r.FormValue("content"), bskyFed, offset); err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// Redirect back to the admin portal
+	redirectBack(w, r)
+}
+
+func (s *server) handleAuthorDelete(w http.ResponseWriter, r *http.Request) {
+	times, err := formTimes(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	bskyDel := r.FormValue("bsky_del") == "on"
+	for _, tm := range times {
+		err := data.DeletePostByTime(tm, bskyDel)
+		switch {
+		case errors.Is(err, data.ErrNotFound), errors.Is(err, data.ErrDeleted):
+			s.renderError(w, r, http.StatusNotFound, nil)
+			return
+		case err != nil:
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	redirectBack(w, r)
+}
+
+func (s *server) handleAuthorFederate(w http.ResponseWriter, r *http.Request) {
+	times, err := formTimes(r)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	for _, tm := range times {
+		err := data.RefederatePost(tm)
+		switch {
+		case errors.Is(err, data.ErrNotFound), errors.Is(err, data.ErrDeleted):
+			s.renderError(w, r, http.StatusNotFound, nil)
+			return
+		case err != nil:
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	redirectBack(w, r)
+}
+
+// handleAuthorRetry retries the federation jobs submitted as "id", or all the dead ones if "dead" is set.
+func (s *server) handleAuthorRetry(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	if r.PostForm.Get("dead") == "on" {
+		if _, err := data.RetryDeadOutboxJobs(); err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		redirectBack(w, r)
+		return
+	}
+	ids := r.PostForm["id"]
+	if len(ids) == 0 {
+		s.renderError(w, r, http.StatusBadRequest, errors.New("no jobs selected"))
+		return
+	}
+	for _, v := range ids {
+		id, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			s.renderError(w, r, http.StatusBadRequest, nil)
+			return
+		}
+		err = data.RetryOutboxJob(id)
+		switch {
+		case errors.Is(err, data.ErrNoJob):
+			s.renderError(w, r, http.StatusNotFound, nil)
+			return
+		case err != nil:
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	redirectBack(w, r)
+}
+
+// editedPost loads the post addressed by the "timestamp" URL parameter, rendering an error page if it fails.
+func (s *server) editedPost(w http.ResponseWriter, r *http.Request) (data.Post, bool) {
+	unix, err := strconv.ParseInt(chi.URLParam(r, "timestamp"), 10, 64)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return data.Post{}, false
+	}
+	p, err := data.GetPostByTime(time.Unix(unix, 0).UTC())
+	switch {
+	case errors.Is(err, data.ErrNotFound), errors.Is(err, data.ErrDeleted):
+		s.renderError(w, r, http.StatusNotFound, nil)
+		return p, false
+	case err != nil:
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return p, false
+	}
+	return p, true
+}
+
+func (s *server) handleAuthorEdit(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.editedPost(w, r)
+	if !ok {
+		return
+	}
+	ap := s.toAuthorPost(p)
+	ad := AuthorData{Edit: &ap, Return: r.URL.Query().Get("return")}
+	if ad.Return == "" {
+		ad.Return = "/author"
+	}
+	s.render(w, r, http.StatusOK, "author-edit", ad)
+}
+
+func (s *server) handleAuthorUpdate(w http.ResponseWriter, r *http.Request) {
+	p, ok := s.editedPost(w, r)
+	if !ok {
+		return
+	}
+	if err := data.UpdatePost(p.Time, r.FormValue("content")); err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if r.FormValue("bsky_fed") == "on" {
+		if err := data.RefederatePost(p.Time); err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	redirectBack(w, r)
+}
+
+// handleAuthorPreview renders the submitted markdown the same way as published posts, for the composer's live preview.
+func (s *server) handleAuthorPreview(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<20)
+	content := r.FormValue("content")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(parseMd([]byte(content)))
+}
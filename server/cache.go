@@ -0,0 +1,72 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aghdom/current/data"
+)
+
+// startedAt is used as the lower bound of Last-Modified, as a new deployment may change how content is rendered.
+var startedAt = time.Now().UTC()
+
+// lastModified returns the time of the latest change that may affect rendered content.
+func lastModified() time.Time {
+	lc := data.LastChange()
+	if lc.After(startedAt) {
+		return lc
+	}
+	return startedAt
+}
+
+// notModified reports whether the request's validators match 'etag' or 'modified'.
+// As per RFC 9110, If-None-Match takes precedence over If-Modified-Since.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimSpace(tag)
+			// Weak comparison, as is required for If-None-Match
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// conditional is a middleware for content derived from the posts. It sets Cache-Control, ETag
+// and Last-Modified headers and answers matching conditional requests with 304 Not Modified,
+// without calling the wrapped handler.
+func conditional(maxAge time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			modified := lastModified()
+			etag := fmt.Sprintf(`W/"%x"`, modified.UnixNano())
+
+			h := w.Header()
+			h.Set("Cache-Control", fmt.Sprintf("public, max-age=%d, must-revalidate", int(maxAge.Seconds())))
+			h.Set("ETag", etag)
+			h.Set("Last-Modified", modified.Format(http.TimeFormat))
+			if (r.Method == http.MethodGet || r.Method == http.MethodHead) && notModified(r, etag, modified) {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// noStore is a middleware preventing any caching of the response, used for private pages.
+func noStore(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		next.ServeHTTP(w, r)
+	})
+}
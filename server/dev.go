@@ -0,0 +1,189 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/aghdom/current/logging"
+)
+
+// reloader notifies the open pages to reload, whenever the theme changes in development mode.
+type reloader struct {
+	mu      sync.Mutex
+	clients map[chan struct{}]struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+func newReloader() *reloader {
+	return &reloader{clients: map[chan struct{}]struct{}{}, done: make(chan struct{})}
+}
+
+func (rl *reloader) subscribe() chan struct{} {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	ch := make(chan struct{}, 1)
+	rl.clients[ch] = struct{}{}
+	return ch
+}
+
+func (rl *reloader) unsubscribe(ch chan struct{}) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	delete(rl.clients, ch)
+}
+
+func (rl *reloader) notify() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	for ch := range rl.clients {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// close disconnects all the clients, so they don't hold up the server's shutdown.
+func (rl *reloader) close() {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if !rl.closed {
+		rl.closed = true
+		close(rl.done)
+	}
+}
+
+// reloadHeartbeat is the interval of comments sent to keep the idle reload streams open.
+const reloadHeartbeat = 25 * time.Second
+
+// handleReload streams a "reload" Server-Sent Event to the page, whenever the theme is reloaded.
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// Every write extends the deadline, overriding the server's write timeout for the long-lived stream
+	write := func(msg string) bool {
+		rc.SetWriteDeadline(time.Now().Add(2 * reloadHeartbeat))
+		if _, err := fmt.Fprint(w, msg); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if !write(": connected\n\n") {
+		return
+	}
+
+	ch := s.reload.subscribe()
+	defer s.reload.unsubscribe(ch)
+	heartbeat := time.NewTicker(reloadHeartbeat)
+	defer heartbeat.Stop()
+	for ok := true; ok; {
+		select {
+		case <-ch:
+			ok = write("data: reload\n\n")
+		case <-heartbeat.C:
+			ok = write(": ping\n\n")
+		case <-r.Context().Done():
+			return
+		case <-s.reload.done:
+			return
+		}
+	}
+}
+
+// watchTheme watches the "templates", "static" and "og" directories under 'roots' and reloads
+// the theme on any change. Empty roots are skipped.
+func (s *server) watchTheme(roots []string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	for _, root := range roots {
+		if root == "" {
+			continue
+		}
+		for _, sub := range []string{"templates", "static", "og"} {
+			dir := filepath.Join(root, sub)
+			if _, err := os.Stat(dir); err != nil {
+				continue
+			}
+			// fsnotify does not watch recursively, so every directory has to be added
+			err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+				if err != nil || !d.IsDir() {
+					return err
+				}
+				return watcher.Add(path)
+			})
+			if err != nil {
+				watcher.Close()
+				return err
+			}
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		// Editors tend to write files in several steps, so changes are debounced
+		var debounce <-chan time.Time
+		for {
+			select {
+			case ev, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if ev.Has(fsnotify.Create) {
+					if fi, err := os.Stat(ev.Name); err == nil && fi.IsDir() {
+						watcher.Add(ev.Name)
+					}
+				}
+				debounce = time.After(100 * time.Millisecond)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				slog.Error("Theme watcher error", logging.Err(err))
+			case <-debounce:
+				v := s.loadView()
+				if v.err != nil {
+					slog.Error("Failed to reload theme", logging.Err(v.err))
+				} else {
+					slog.Info("Reloaded theme")
+				}
+				s.view.Store(v)
+				s.reload.notify()
+			case <-s.reload.done:
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// renderDevError shows 'err' in place of the page. It is only used in development mode,
+// where the templates might be broken while they are being edited.
+func renderDevError(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Template error</title></head>
+<body style="font-family: monospace; padding: 2em;">
+<h1>Template error</h1>
+<pre style="white-space: pre-wrap;">%s</pre>
+<script>new EventSource("/_dev/reload").onmessage = () => location.reload();</script>
+</body>
+</html>`, html.EscapeString(err.Error()))
+}
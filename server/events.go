@@ -0,0 +1,284 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/logging"
+)
+
+// EventsConfig configures the live timeline stream.
+type EventsConfig struct {
+	Enabled bool
+	// MaxClients caps the concurrent streams, as each one holds a connection open
+	MaxClients int
+	// Heartbeat is the interval of comments sent to keep idle connections from being closed by proxies
+	Heartbeat time.Duration
+	// History is the number of past events kept for clients resuming with Last-Event-ID
+	History int
+}
+
+func initEventsConfig() EventsConfig {
+	cfg := EventsConfig{
+		Enabled:    viper.GetBool("events.enabled"),
+		MaxClients: viper.GetInt("events.max_clients"),
+		Heartbeat:  viper.GetDuration("events.heartbeat"),
+		History:    viper.GetInt("events.history"),
+	}
+	if cfg.Heartbeat <= 0 {
+		cfg.Heartbeat = 25 * time.Second
+	}
+	return cfg
+}
+
+// liveEvent is a Server-Sent Event about a changed post.
+type liveEvent struct {
+	ID   int64
+	Name string
+	Data []byte
+}
+
+// liveEventData is the payload of a live event. HTML is the rendered post, it's empty for deleted posts.
+type liveEventData struct {
+	Unix int64  `json:"unix"`
+	HTML string `json:"html,omitempty"`
+}
+
+// broker fans out the events about changed posts to all the connected streams.
+type broker struct {
+	mu      sync.Mutex
+	cfg     EventsConfig
+	clients map[chan liveEvent]struct{}
+	// history holds the latest events, oldest first
+	history []liveEvent
+	lastID  int64
+	// floor is the ID of the latest event, which is no longer retained. Clients which last saw
+	// an event at or before it may have missed some and have to reload instead.
+	floor  int64
+	done   chan struct{}
+	closed bool
+	// changes are waiting to be rendered and published, while 'rendering' is set
+	changes   []data.Change
+	rendering bool
+}
+
+func newBroker(cfg EventsConfig) *broker {
+	// Event IDs are based on the time, so they keep increasing across restarts
+	now := time.Now().UnixMilli()
+	return &broker{cfg: cfg, clients: map[chan liveEvent]struct{}{}, lastID: now, floor: now, done: make(chan struct{})}
+}
+
+// subscription is a connected stream, along with the events it has to catch up on.
+type subscription struct {
+	ch     chan liveEvent
+	replay []liveEvent
+	// reset is set, if the events since Last-Event-ID are no longer known
+	reset bool
+}
+
+// subscribe connects a new stream, which last saw the event 'lastID' (0 for a new one).
+// It fails, if the maximum number of streams is already connected.
+func (b *broker) subscribe(lastID int64) (subscription, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || (b.cfg.MaxClients > 0 && len(b.clients) >= b.cfg.MaxClients) {
+		return subscription{}, false
+	}
+	sub := subscription{ch: make(chan liveEvent, 16)}
+	if lastID > 0 {
+		if lastID < b.floor {
+			sub.reset = true
+		} else {
+			for _, ev := range b.history {
+				if ev.ID > lastID {
+					sub.replay = append(sub.replay, ev)
+				}
+			}
+		}
+	}
+	b.clients[sub.ch] = struct{}{}
+	return sub, true
+}
+
+func (b *broker) unsubscribe(ch chan liveEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.clients[ch]; ok {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+func (b *broker) publish(name string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	id := time.Now().UnixMilli()
+	if id <= b.lastID {
+		id = b.lastID + 1
+	}
+	b.lastID = id
+	ev := liveEvent{ID: id, Name: name, Data: payload}
+
+	b.history = append(b.history, ev)
+	if over := len(b.history) - b.cfg.History; over > 0 {
+		b.floor = b.history[over-1].ID
+		b.history = append([]liveEvent(nil), b.history[over:]...)
+	}
+	for ch := range b.clients {
+		select {
+		case ch <- ev:
+		default:
+			// The client can't keep up, it will reconnect and catch up from the history
+			delete(b.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// close disconnects all the streams, so they don't hold up the server's shutdown.
+func (b *broker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.closed {
+		b.closed = true
+		close(b.done)
+	}
+}
+
+// publishChange queues the changed post to be published to the live streams. The changes are rendered in the background,
+// in the order they were made, so the author's request doesn't wait for them, nor fails along with the theme.
+func (s *server) publishChange(c data.Change) {
+	b := s.events
+	b.mu.Lock()
+	b.changes = append(b.changes, c)
+	start := !b.rendering
+	b.rendering = true
+	b.mu.Unlock()
+	if start {
+		data.RunBackground(s.publishChanges)
+	}
+}
+
+// publishChanges publishes the queued changes, until there are none left.
+func (s *server) publishChanges() {
+	b := s.events
+	for {
+		b.mu.Lock()
+		if len(b.changes) == 0 {
+			b.rendering = false
+			b.mu.Unlock()
+			return
+		}
+		c := b.changes[0]
+		b.changes = b.changes[1:]
+		b.mu.Unlock()
+		s.renderChange(c)
+	}
+}
+
+// renderChange renders the changed post and publishes it to the live streams.
+func (s *server) renderChange(c data.Change) {
+	payload := liveEventData{Unix: c.Time.Unix()}
+	if c.Kind != data.PostDeleted {
+		// A theme which failed to load in development mode has no templates
+		v := s.view.Load()
+		if v.err != nil || v.tmpl == nil {
+			slog.Warn("Not publishing changed post, the theme failed to load", logging.Post(c.Time))
+			return
+		}
+		p, err := data.GetPostByTime(c.Time)
+		if err != nil {
+			slog.Error("Failed to load changed post", logging.Post(c.Time), logging.Err(err))
+			return
+		}
+		var buf bytes.Buffer
+		if err := v.tmpl.ExecuteTemplate(&buf, "post", s.transformPost(p)); err != nil {
+			slog.Error("Failed to render changed post", logging.Post(c.Time), logging.Err(err))
+			return
+		}
+		payload.HTML = buf.String()
+	}
+	b, _ := json.Marshal(payload)
+	s.events.publish(string(c.Kind), b)
+}
+
+func writeEvent(w http.ResponseWriter, ev liveEvent) error {
+	_, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Name, ev.Data)
+	return err
+}
+
+// handleEvents streams the changes to the posts as Server-Sent Events. Clients reconnecting with
+// Last-Event-ID get the events they missed, or a "reset" event if they are no longer known.
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	lastID, _ := strconv.ParseInt(r.Header.Get("Last-Event-ID"), 10, 64)
+	sub, ok := s.events.subscribe(lastID)
+	if !ok {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many live streams", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.events.unsubscribe(sub.ch)
+
+	rc := http.NewResponseController(w)
+	// Every write extends the deadline, overriding the server's write timeout for the long-lived stream
+	write := func(fn func() error) bool {
+		rc.SetWriteDeadline(time.Now().Add(2 * s.events.cfg.Heartbeat))
+		if err := fn(); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	ok = write(func() error {
+		_, err := fmt.Fprint(w, "retry: 5000\n\n")
+		return err
+	})
+	if ok && sub.reset {
+		ok = write(func() error {
+			return writeEvent(w, liveEvent{ID: s.events.lastEventID(), Name: "reset", Data: []byte("{}")})
+		})
+	}
+	for _, ev := range sub.replay {
+		ok = ok && write(func() error { return writeEvent(w, ev) })
+	}
+
+	heartbeat := time.NewTicker(s.events.cfg.Heartbeat)
+	defer heartbeat.Stop()
+	for ok {
+		select {
+		case ev, open := <-sub.ch:
+			if !open {
+				return
+			}
+			ok = write(func() error { return writeEvent(w, ev) })
+		case <-heartbeat.C:
+			ok = write(func() error {
+				_, err := fmt.Fprint(w, ": ping\n\n")
+				return err
+			})
+		case <-r.Context().Done():
+			return
+		case <-s.events.done:
+			return
+		}
+	}
+}
+
+func (b *broker) lastEventID() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.lastID
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/render"
+	"github.com/aghdom/current/search"
+	"github.com/aghdom/current/site"
+)
+
+// indexPageSize is the number of posts on a page of the timeline.
+const indexPageSize = 10
+
+// parseCursor parses the Unix timestamp in the query parameter 'key', it is zero if unset.
+func parseCursor(r *http.Request, key string) (time.Time, error) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	unix, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || unix < 0 {
+		return time.Time{}, fmt.Errorf("invalid %s cursor %q", key, v)
+	}
+	return time.Unix(unix, 0).UTC(), nil
+}
+
+// timelineURL returns the URL of the timeline of the search 'query', with the cursor 'key' set to 'tm', if not zero.
+func timelineURL(query, key string, tm time.Time) string {
+	return cursorURL("/", query, key, tm)
+}
+
+// cursorURL returns the URL of the page at 'path' listing the posts matching 'query', with the cursor 'key' set to 'tm', if not zero.
+func cursorURL(path, query, key string, tm time.Time) string {
+	v := url.Values{}
+	if query != "" {
+		v.Set("q", query)
+	}
+	if !tm.IsZero() {
+		v.Set(key, strconv.FormatInt(tm.Unix(), 10))
+	}
+	if len(v) == 0 {
+		return path
+	}
+	return path + "?" + v.Encode()
+}
+
+// redirectPage redirects the page number in the query parameter 'param' of the former offset pagination
+// of 'size' posts at 'path' to the equivalent cursor.
+func (s *server) redirectPage(w http.ResponseWriter, r *http.Request, q search.Query, path, param string, size int) {
+	page, err := strconv.Atoi(r.URL.Query().Get(param))
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	if page <= 1 {
+		http.Redirect(w, r, cursorURL(path, q.Raw, "", time.Time{}), http.StatusFound)
+		return
+	}
+	// The page starts right after the last post of the previous one
+	last, err := data.PostCursor(q, (page-1)*size-1)
+	switch {
+	case errors.Is(err, data.ErrNotFound):
+		s.renderError(w, r, http.StatusNotFound, nil)
+		return
+	case err != nil:
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	// Not permanent, as the same page number points at older posts as new ones are created
+	http.Redirect(w, r, cursorURL(path, q.Raw, "before", last), http.StatusFound)
+}
+
+func (s *server) handleIndex(w http.ResponseWriter, r *http.Request) {
+	q, err := search.Parse(r.URL.Query().Get("q"), s.site.Location)
+	pd := PageData{
+		Title:    s.site.Title,
+		SubTitle: s.site.Description,
+		Search:   true,
+		Query:    q.Raw,
+	}
+	if err != nil {
+		// Show what's wrong with the query, along with the search form to fix it
+		pd.Title = fmt.Sprintf("Search '%s'", r.URL.Query().Get("q"))
+		pd.SubTitle = err.Error()
+		pd.Query = r.URL.Query().Get("q")
+		s.render(w, r, http.StatusBadRequest, "index", pd)
+		return
+	}
+	if r.URL.Query().Has("p") {
+		s.redirectPage(w, r, q, "/", "p", indexPageSize)
+		return
+	}
+	before, err := parseCursor(r, "before")
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	after, err := parseCursor(r, "after")
+	if err != nil || (!before.IsZero() && !after.IsZero()) {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	if q.Raw != "" {
+		pd.Title = fmt.Sprintf("Search '%s'", q.Raw)
+		pd.SearchFeed = data.SearchPath + "?" + url.Values{"q": {q.Raw}}.Encode()
+	}
+
+	page, err := data.GetPostsPage(q, before, after, indexPageSize)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if len(page.Posts) > 0 {
+		if page.Newer {
+			pd.Newer = timelineURL(q.Raw, "after", page.Posts[0].Time)
+		}
+		if page.Older {
+			pd.Older = timelineURL(q.Raw, "before", page.Posts[len(page.Posts)-1].Time)
+		}
+	} else if !before.IsZero() || !after.IsZero() {
+		// Past the end of the timeline, e.g. after the posts of an old cursor were deleted
+		pd.Newer = timelineURL(q.Raw, "", time.Time{})
+	}
+	// only the latest posts get the new ones prepended
+	pd.Live = s.events != nil && q.Raw == "" && !page.Newer
+	highlights := q.Highlights()
+	for _, p := range page.Posts {
+		fp := s.transformPost(p)
+		fp.Content = template.HTML(render.Mark([]byte(fp.Content), highlights))
+		pd.Feed = append(pd.Feed, fp)
+	}
+	s.render(w, r, http.StatusOK, "index", pd)
+}
+
+func (s *server) handleAbout(w http.ResponseWriter, r *http.Request) {
+	var ad AboutData
+	if len(s.site.About) > 0 {
+		ad.About = template.HTML(parseMd(s.site.About))
+	}
+	s.render(w, r, http.StatusOK, "about", ad)
+}
+
+func (s *server) handlePost(w http.ResponseWriter, r *http.Request) {
+	unix, err := strconv.ParseInt(chi.URLParam(r, "timestamp"), 10, 64)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	p, err := data.GetPostByTime(time.Unix(unix, 0).UTC())
+	switch {
+	case errors.Is(err, data.ErrNotFound):
+		s.renderError(w, r, http.StatusNotFound, nil)
+		return
+	case errors.Is(err, data.ErrDeleted):
+		s.renderError(w, r, http.StatusGone, nil)
+		return
+	case err != nil:
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	pd := PageData{
+		Title: p.Time.In(s.site.Location).Format("2006/01/02 15:04"),
+		Feed:  []FeedPost{s.transformPost(p)},
+		Meta:  s.postMeta(p),
+	}
+	s.render(w, r, http.StatusOK, "index", pd)
+}
+
+// parseDate parses the date in 'y', 'm' and 'd' as the midnight starting it in 'loc'. Unlike time.Date,
+// it does not normalize out-of-range values, so "2023/02/30" is rejected instead of becoming "2023/03/02".
+func parseDate(y, m, d string, loc *time.Location) (time.Time, error) {
+	return time.ParseInLocation("2006/1/2", y+"/"+m+"/"+d, loc)
+}
+
+// handleSearchFeed serves the Atom feed of the search in "q".
+func (s *server) handleSearchFeed(w http.ResponseWriter, r *http.Request) {
+	q, err := search.Parse(r.URL.Query().Get("q"), s.site.Location)
+	if err != nil || q.IsZero() {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	feed, err := data.GetSearchFeed(s.site, q)
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/atom+xml")
+	w.Write(feed)
+}
+
+// handleFeed serves the page of the feed generated by 'feedFn' with the given content type.
+func (s *server) handleFeed(feedFn func(site.Config, time.Time, time.Time) ([]byte, error), contentType string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("page") {
+			s.redirectPage(w, r, search.Query{}, r.URL.Path, "page", data.FeedItems())
+			return
+		}
+		before, err := parseCursor(r, "before")
+		if err != nil {
+			s.renderError(w, r, http.StatusBadRequest, nil)
+			return
+		}
+		after, err := parseCursor(r, "after")
+		if err != nil || (!before.IsZero() && !after.IsZero()) {
+			s.renderError(w, r, http.StatusBadRequest, nil)
+			return
+		}
+		feed, err := feedFn(s.site, before, after)
+		switch {
+		case errors.Is(err, data.ErrNotFound):
+			s.renderError(w, r, http.StatusNotFound, nil)
+			return
+		case err != nil:
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		// The first page is the WebSub topic, see RFC 8288 for the links
+		if before.IsZero() && after.IsZero() {
+			for _, hub := range data.FeedHubs(s.site) {
+				w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"hub\"", hub))
+			}
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"self\"", s.site.URL(r.URL.Path)))
+		}
+		w.Header().Add("Content-Type", contentType)
+		w.Write(feed)
+	}
+}
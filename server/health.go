@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/data"
+)
+
+// HealthConfig configures the checks of the readiness endpoint.
+type HealthConfig struct {
+	// MinFreeBytes is the free space required on the DB's volume
+	MinFreeBytes uint64
+	// Bsky makes readiness depend on the latest attempt to create a Bluesky session
+	Bsky bool
+	// MaxFederationBacklog is the number of posts allowed to wait for federation, 0 disables the check
+	MaxFederationBacklog int
+}
+
+func initHealthConfig() HealthConfig {
+	return HealthConfig{
+		MinFreeBytes:         uint64(viper.GetInt64("health.min_free_bytes")),
+		Bsky:                 viper.GetBool("health.bsky"),
+		MaxFederationBacklog: viper.GetInt("health.max_federation_backlog"),
+	}
+}
+
+const (
+	statusOK   = "ok"
+	statusFail = "fail"
+)
+
+type checkResult struct {
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Uptime string                 `json:"uptime,omitempty"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, report healthReport) {
+	status := http.StatusOK
+	if report.Status != statusOK {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// handleHealthz reports the liveness of the process. It doesn't depend on anything external,
+// so a failing dependency makes the server unready rather than getting it restarted.
+func (s *server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, healthReport{Status: statusOK, Uptime: time.Since(startedAt).Round(time.Second).String()})
+}
+
+// handleReadyz reports whether the server is able to serve and accept posts.
+func (s *server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	checks := map[string]checkResult{}
+	version, err := data.CheckDB(ctx)
+	checks["db"] = result(err == nil, errDetail(err))
+	if version != 0 || err == nil {
+		checks["schema"] = result(version == data.SchemaVersion, fmt.Sprintf("version %d, expected %d", version, data.SchemaVersion))
+	}
+
+	if free, err := data.DBFreeBytes(); errors.Is(err, errors.ErrUnsupported) {
+		// Free space can't be determined on this platform
+	} else if err != nil {
+		checks["disk"] = result(false, err.Error())
+	} else {
+		checks["disk"] = result(free >= s.health.MinFreeBytes, fmt.Sprintf("%d MiB free, %d MiB required", free>>20, s.health.MinFreeBytes>>20))
+	}
+
+	if s.health.Bsky {
+		last := data.LastBskySession()
+		switch {
+		case last.At.IsZero():
+			checks["bsky"] = result(true, "no session requested yet")
+		case last.Err != nil:
+			checks["bsky"] = result(false, fmt.Sprintf("session at %s failed: %s", last.At.UTC().Format(time.RFC3339), last.Err))
+		default:
+			checks["bsky"] = result(true, "session at "+last.At.UTC().Format(time.RFC3339))
+		}
+	}
+	if s.health.MaxFederationBacklog > 0 {
+		depth := data.FederationQueueDepth()
+		checks["federation"] = result(depth <= s.health.MaxFederationBacklog,
+			fmt.Sprintf("%d waiting, at most %d allowed", depth, s.health.MaxFederationBacklog))
+	}
+
+	report := healthReport{Status: statusOK, Checks: checks}
+	for _, c := range checks {
+		if c.Status != statusOK {
+			report.Status = statusFail
+		}
+	}
+	writeHealth(w, report)
+}
+
+func result(ok bool, detail string) checkResult {
+	if ok {
+		return checkResult{Status: statusOK, Detail: detail}
+	}
+	return checkResult{Status: statusFail, Detail: detail}
+}
+
+func errDetail(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/aghdom/current/logging"
+)
+
+// reqLogger returns the default logger with the request's ID attached.
+func reqLogger(r *http.Request) *slog.Logger {
+	return slog.With(logging.KeyRequestID, middleware.GetReqID(r.Context()))
+}
+
+// accessLog logs every request once it has been served. The query string is left out,
+// as it's not needed to tell requests apart and may carry anything.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		reqLogger(r).LogAttrs(r.Context(), level, "Request",
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int("bytes", ww.BytesWritten()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+			slog.String("user_agent", r.UserAgent()),
+		)
+	})
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/metrics"
+	"github.com/aghdom/current/search"
+)
+
+// MetricsConfig configures the Prometheus endpoint.
+type MetricsConfig struct {
+	Enabled bool
+	// Token, if set, must be sent as a bearer token to read the metrics
+	Token string
+	// Addr, if set, is a separate listen address for the metrics, e.g. a port only reachable internally
+	Addr string
+}
+
+func initMetricsConfig() MetricsConfig {
+	return MetricsConfig{
+		Enabled: viper.GetBool("metrics.enabled"),
+		Token:   viper.GetString("metrics.token"),
+		Addr:    viper.GetString("metrics.addr"),
+	}
+}
+
+func init() {
+	metrics.Gauge("current_posts", "Number of published posts.", func() float64 {
+		count, err := data.CountPosts(search.Query{})
+		if err != nil {
+			return -1
+		}
+		return float64(count)
+	})
+	metrics.Gauge("current_federation_queue_depth", "Number of posts waiting to be federated to, or deleted from Bluesky.", func() float64 {
+		return float64(data.FederationQueueDepth())
+	})
+	metrics.Gauge("current_federation_dead_jobs", "Number of federation jobs which failed for good and wait to be retried manually.", func() float64 {
+		return float64(data.FederationDeadJobs())
+	})
+}
+
+// instrument records the count and latency of requests by their chi route pattern,
+// so e.g. all the post permalinks are counted as "/posts/{timestamp}".
+func instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePatterns) > 0 {
+			// chi trims the trailing slash, which leaves the index route empty
+			if route = rctx.RoutePattern(); route == "" {
+				route = "/"
+			}
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		metrics.HTTPRequests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		metrics.HTTPDuration.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+// handleMetrics serves the metrics, checking the bearer token if one is configured.
+func (s *server) handleMetrics() http.Handler {
+	h := metrics.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.metrics.Token != "" {
+			if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.metrics.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="metrics"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				return
+			}
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io/fs"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/site"
+)
+
+// ogCardFile is the theme file describing the layout of the generated Open Graph images.
+const ogCardFile = "og/card.json"
+
+// ogCard is the layout of the Open Graph images generated for posts. Colours are hex codes,
+// fonts and the logo are paths of TrueType and PNG files in the theme.
+type ogCard struct {
+	Width       int     `json:"width"`
+	Height      int     `json:"height"`
+	Padding     int     `json:"padding"`
+	Background  string  `json:"background"`
+	Foreground  string  `json:"foreground"`
+	Muted       string  `json:"muted"`
+	Accent      string  `json:"accent"`
+	Font        string  `json:"font"`
+	BoldFont    string  `json:"bold_font"`
+	TitleSize   float64 `json:"title_size"`
+	TextSize    float64 `json:"text_size"`
+	MinTextSize float64 `json:"min_text_size"`
+	LineHeight  float64 `json:"line_height"`
+	MaxLines    int     `json:"max_lines"`
+	Logo        string  `json:"logo"`
+
+	bg, fg, muted, accent color.Color
+	regular, bold         *opentype.Font
+	logo                  image.Image
+}
+
+// loadOGCard reads the card layout from the theme, along with the fonts and logo it references.
+func loadOGCard(theme fs.FS) (*ogCard, error) {
+	b, err := fs.ReadFile(theme, ogCardFile)
+	if err != nil {
+		return nil, err
+	}
+	c := &ogCard{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("%s: %w", ogCardFile, err)
+	}
+	if c.Width <= 0 || c.Height <= 0 || c.TextSize <= 0 || c.TitleSize <= 0 || c.MaxLines <= 0 {
+		return nil, fmt.Errorf("%s: width, height, text_size, title_size and max_lines must be positive", ogCardFile)
+	}
+	if c.MinTextSize <= 0 || c.MinTextSize > c.TextSize {
+		c.MinTextSize = c.TextSize
+	}
+	if c.LineHeight <= 0 {
+		c.LineHeight = 1.3
+	}
+
+	for _, col := range []struct {
+		hex string
+		dst *color.Color
+	}{{c.Background, &c.bg}, {c.Foreground, &c.fg}, {c.Muted, &c.muted}, {c.Accent, &c.accent}} {
+		if *col.dst, err = parseHexColor(col.hex); err != nil {
+			return nil, fmt.Errorf("%s: %w", ogCardFile, err)
+		}
+	}
+	if c.regular, err = loadFont(theme, c.Font, goregular.TTF); err != nil {
+		return nil, err
+	}
+	if c.bold, err = loadFont(theme, c.BoldFont, gobold.TTF); err != nil {
+		return nil, err
+	}
+	if c.Logo != "" {
+		f, err := theme.Open(c.Logo)
+		if err != nil {
+			return nil, fmt.Errorf("%s: logo: %w", ogCardFile, err)
+		}
+		defer f.Close()
+		if c.logo, err = png.Decode(f); err != nil {
+			return nil, fmt.Errorf("%s: logo: %w", ogCardFile, err)
+		}
+	}
+	return c, nil
+}
+
+// loadFont parses the font at 'name' in the theme, or 'fallback' if no name is given.
+func loadFont(theme fs.FS, name string, fallback []byte) (*opentype.Font, error) {
+	src := fallback
+	if name != "" {
+		var err error
+		if src, err = fs.ReadFile(theme, name); err != nil {
+			return nil, fmt.Errorf("%s: font: %w", ogCardFile, err)
+		}
+	}
+	f, err := opentype.Parse(src)
+	if err != nil {
+		return nil, fmt.Errorf("%s: font %s: %w", ogCardFile, name, err)
+	}
+	return f, nil
+}
+
+// parseHexColor parses colours in the "#rgb", "#rrggbb" or "#rrggbbaa" form.
+func parseHexColor(s string) (color.Color, error) {
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return nil, fmt.Errorf("invalid colour %q", s)
+	}
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+func (c *ogCard) face(f *opentype.Font, size float64) (font.Face, error) {
+	return opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+}
+
+// supported drops the characters missing from the font 'f', e.g. emoji, which would be drawn as boxes.
+func supported(f *opentype.Font, s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return ' '
+		}
+		if idx, err := f.GlyphIndex(nil, r); err != nil || idx == 0 {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// wrap breaks 'text' into lines no wider than 'width'. Words longer than a line are split.
+func wrap(face font.Face, text string, width int) []string {
+	max := fixed.I(width)
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(text) {
+		candidate := word
+		if line != "" {
+			candidate = line + " " + word
+		}
+		if font.MeasureString(face, candidate) <= max {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		line = ""
+		for _, r := range word {
+			if line != "" && font.MeasureString(face, line+string(r)) > max {
+				lines = append(lines, line)
+				line = ""
+			}
+			line += string(r)
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// ellipsize shortens 'line' until it fits into 'width' with an ellipsis appended.
+func ellipsize(face font.Face, line string, width int) string {
+	runes := []rune(line)
+	for len(runes) > 0 && font.MeasureString(face, string(runes)+"…") > fixed.I(width) {
+		runes = runes[:len(runes)-1]
+	}
+	return strings.TrimRight(string(runes), " ,.;:") + "…"
+}
+
+func drawString(dst draw.Image, face font.Face, col color.Color, x, y int, s string) {
+	d := font.Drawer{Dst: dst, Src: image.NewUniform(col), Face: face, Dot: fixed.P(x, y)}
+	d.DrawString(s)
+}
+
+// Render draws the card of the post 'p' and encodes it as PNG. The post's text is shrunk
+// down to the minimum text size to fit the card, and truncated if it still doesn't.
+func (c *ogCard) Render(p data.Post, siteCfg site.Config) ([]byte, error) {
+	img := image.NewRGBA(image.Rect(0, 0, c.Width, c.Height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c.bg), image.Point{}, draw.Src)
+	// Accent bar along the left edge
+	draw.Draw(img, image.Rect(0, 0, c.Padding/4, c.Height), image.NewUniform(c.accent), image.Point{}, draw.Src)
+
+	pad := c.Padding
+	inner := c.Width - 2*pad
+
+	titleFace, err := c.face(c.bold, c.TitleSize)
+	if err != nil {
+		return nil, err
+	}
+	defer titleFace.Close()
+	titleWidth := inner
+	if c.logo != nil {
+		lb := c.logo.Bounds()
+		// The logo is drawn at its own size, in the top right corner
+		draw.Draw(img, image.Rect(c.Width-pad-lb.Dx(), pad, c.Width-pad, pad+lb.Dy()), c.logo, lb.Min, draw.Over)
+		titleWidth -= lb.Dx() + pad/2
+	}
+	title := supported(c.bold, siteCfg.Title)
+	if font.MeasureString(titleFace, title) > fixed.I(titleWidth) {
+		title = ellipsize(titleFace, title, titleWidth)
+	}
+	top := pad + int(c.TitleSize)
+	drawString(img, titleFace, c.fg, pad, top, title)
+
+	metaFace, err := c.face(c.regular, c.TitleSize*0.75)
+	if err != nil {
+		return nil, err
+	}
+	defer metaFace.Close()
+	bottom := c.Height - pad
+	drawString(img, metaFace, c.muted, pad, bottom, p.Time.In(siteCfg.Location).Format("2006/01/02 15:04"))
+	domain := supported(c.regular, siteCfg.Domain())
+	drawString(img, metaFace, c.muted, c.Width-pad-font.MeasureString(metaFace, domain).Ceil(), bottom, domain)
+
+	// The post's text fills the space between the title and the footer
+	text := supported(c.regular, plainText(p.Content))
+	textTop := top + pad/2
+	area := bottom - int(c.TitleSize*0.75) - pad/2 - textTop
+	var face font.Face
+	var lines []string
+	var lineHeight int
+	for size := c.TextSize; ; size *= 0.9 {
+		if size < c.MinTextSize {
+			size = c.MinTextSize
+		}
+		if face != nil {
+			face.Close()
+		}
+		if face, err = c.face(c.regular, size); err != nil {
+			return nil, err
+		}
+		lineHeight = max(int(size*c.LineHeight), 1)
+		lines = wrap(face, text, inner)
+		if (len(lines) <= c.MaxLines && len(lines)*lineHeight <= area) || size == c.MinTextSize {
+			break
+		}
+	}
+	defer face.Close()
+	// A card too small for a single line still gets one, rather than all of them overflowing it
+	fit := max(min(c.MaxLines, area/lineHeight), 1)
+	if len(lines) > fit {
+		lines[fit-1] = ellipsize(face, lines[fit-1], inner)
+		lines = lines[:fit]
+	}
+	y := textTop + lineHeight
+	for _, line := range lines {
+		drawString(img, face, c.fg, pad, y, line)
+		y += lineHeight
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ogCacheSize is the number of rendered images kept in memory.
+const ogCacheSize = 128
+
+type ogEntry struct {
+	view    *view
+	changed time.Time
+	png     []byte
+}
+
+// ogCache keeps the recently rendered images. Entries are stale once the posts or the theme change.
+type ogCache struct {
+	mu      sync.Mutex
+	entries map[int64]ogEntry
+}
+
+func (c *ogCache) get(ts int64, v *view) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[ts]
+	if !ok || e.view != v || !e.changed.Equal(data.LastChange()) {
+		return nil, false
+	}
+	return e.png, true
+}
+
+func (c *ogCache) put(ts int64, v *view, png []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil || len(c.entries) >= ogCacheSize {
+		c.entries = make(map[int64]ogEntry, ogCacheSize)
+	}
+	c.entries[ts] = ogEntry{view: v, changed: data.LastChange(), png: png}
+}
+
+func (s *server) handlePostImage(w http.ResponseWriter, r *http.Request) {
+	unix, err := strconv.ParseInt(chi.URLParam(r, "timestamp"), 10, 64)
+	if err != nil {
+		s.renderError(w, r, http.StatusBadRequest, nil)
+		return
+	}
+	v := s.view.Load()
+	img, ok := s.og.get(unix, v)
+	if !ok {
+		p, err := data.GetPostByTime(time.Unix(unix, 0).UTC())
+		switch {
+		case errors.Is(err, data.ErrNotFound):
+			s.renderError(w, r, http.StatusNotFound, nil)
+			return
+		case errors.Is(err, data.ErrDeleted):
+			s.renderError(w, r, http.StatusGone, nil)
+			return
+		case err != nil:
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if v.og == nil {
+			s.renderError(w, r, http.StatusInternalServerError, v.err)
+			return
+		}
+		if img, err = v.og.Render(p, s.site); err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		s.og.put(unix, v, img)
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Length", strconv.Itoa(len(img)))
+	w.Write(img)
+}
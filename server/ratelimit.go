@@ -0,0 +1,278 @@
+package server
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitConfig configures the per-client limits of requests and failed logins.
+type RateLimitConfig struct {
+	Enabled bool
+	// TrustedProxies are the networks of reverse proxies, whose client IP headers are believed
+	TrustedProxies []*net.IPNet
+	Public         limit
+	Search         limit
+	Admin          limit
+	// MaxFailures is the number of failed logins before a client gets locked out
+	MaxFailures int
+	// Lockout is the duration of the first lockout, doubled with each further failure up to MaxLockout
+	Lockout    time.Duration
+	MaxLockout time.Duration
+}
+
+// limit is a token bucket refilled with 'Rate' tokens per second and holding up to 'Burst' of them.
+type limit struct {
+	Rate  float64
+	Burst int
+}
+
+func initRateLimitConfig() (RateLimitConfig, error) {
+	cfg := RateLimitConfig{
+		Enabled:     viper.GetBool("ratelimit.enabled"),
+		Public:      limit{viper.GetFloat64("ratelimit.public.rate"), viper.GetInt("ratelimit.public.burst")},
+		Search:      limit{viper.GetFloat64("ratelimit.search.rate"), viper.GetInt("ratelimit.search.burst")},
+		Admin:       limit{viper.GetFloat64("ratelimit.admin.rate"), viper.GetInt("ratelimit.admin.burst")},
+		MaxFailures: viper.GetInt("ratelimit.login.max_failures"),
+		Lockout:     viper.GetDuration("ratelimit.login.lockout"),
+		MaxLockout:  viper.GetDuration("ratelimit.login.max_lockout"),
+	}
+	for _, cidr := range viper.GetStringSlice("ratelimit.trusted_proxies") {
+		if !strings.Contains(cidr, "/") {
+			// A single address
+			if strings.Contains(cidr, ":") {
+				cidr += "/128"
+			} else {
+				cidr += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return cfg, fmt.Errorf("ratelimit.trusted_proxies: %w", err)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, n)
+	}
+	return cfg, nil
+}
+
+func (c RateLimitConfig) trusted(ip net.IP) bool {
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client making the request. The headers set by reverse proxies
+// are only honoured, if the request comes from a trusted one, as anyone else could forge them.
+func (c RateLimitConfig) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	remote := net.ParseIP(host)
+	if remote == nil || !c.trusted(remote) {
+		return host
+	}
+	if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("Fly-Client-IP"))); ip != nil {
+		return ip.String()
+	}
+	// Each proxy appends the address it received the request from, so the client
+	// is the rightmost address, which isn't one of the trusted proxies.
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !c.trusted(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+// idleExpiry is how long the state of a client is kept after its last request.
+const idleExpiry = 10 * time.Minute
+
+type bucket struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+// limiter keeps a token bucket per client.
+type limiter struct {
+	mu      sync.Mutex
+	limit   limit
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newLimiter(l limit) *limiter {
+	return &limiter{limit: l, buckets: map[string]*bucket{}, swept: time.Now()}
+}
+
+// reserve takes a token from the bucket of 'key' and returns zero, or how long to wait for one, if it's empty.
+func (l *limiter) reserve(key string) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.swept) > time.Minute {
+		for k, b := range l.buckets {
+			if now.Sub(b.seen) > idleExpiry {
+				delete(l.buckets, k)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{lim: rate.NewLimiter(rate.Limit(l.limit.Rate), l.limit.Burst)}
+		l.buckets[key] = b
+	}
+	b.seen = now
+	res := b.lim.ReserveN(now, 1)
+	if !res.OK() {
+		return time.Duration(math.MaxInt64)
+	}
+	if d := res.DelayFrom(now); d > 0 {
+		res.CancelAt(now)
+		return d
+	}
+	return 0
+}
+
+// tooManyRequests responds with 429, telling the client when to try again.
+func (s *server) tooManyRequests(w http.ResponseWriter, r *http.Request, retry time.Duration) {
+	secs := int64(math.Ceil(retry.Seconds()))
+	if secs < 1 || retry < 0 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	s.renderError(w, r, http.StatusTooManyRequests, nil)
+}
+
+// rateLimit limits the requests per client to 'l'. If 'match' is set, only the requests it matches are counted.
+func (s *server) rateLimit(l limit, match func(r *http.Request) bool) func(http.Handler) http.Handler {
+	if !s.limits.Enabled || l.Rate <= 0 {
+		return func(next http.Handler) http.Handler { return next }
+	}
+	lim := newLimiter(l)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if match == nil || match(r) {
+				if d := lim.reserve(s.limits.clientIP(r)); d > 0 {
+					s.tooManyRequests(w, r, d)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func isSearch(r *http.Request) bool {
+	return r.URL.Query().Get("q") != ""
+}
+
+type loginState struct {
+	failures int
+	until    time.Time
+	seen     time.Time
+}
+
+// lockouts tracks failed logins per client.
+type lockouts struct {
+	mu      sync.Mutex
+	clients map[string]*loginState
+}
+
+// locked returns how much longer 'key' is locked out for.
+func (l *lockouts) locked(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.clients[key]; ok {
+		return time.Until(st.until)
+	}
+	return 0
+}
+
+// fail records a failed login of 'key' and returns the lockout it has earned, if any.
+// Starting with the MaxFailures-th failure, each one doubles the lockout.
+func (l *lockouts) fail(key string, cfg RateLimitConfig) time.Duration {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = map[string]*loginState{}
+	}
+	for k, st := range l.clients {
+		if now.Sub(st.seen) > cfg.MaxLockout+idleExpiry {
+			delete(l.clients, k)
+		}
+	}
+	st, ok := l.clients[key]
+	if !ok {
+		st = &loginState{}
+		l.clients[key] = st
+	}
+	st.failures++
+	st.seen = now
+	if cfg.MaxFailures <= 0 || st.failures < cfg.MaxFailures {
+		return 0
+	}
+	lockout := cfg.MaxLockout
+	if n := st.failures - cfg.MaxFailures; n < 32 {
+		lockout = min(cfg.Lockout<<n, cfg.MaxLockout)
+	}
+	st.until = now.Add(lockout)
+	return lockout
+}
+
+func (l *lockouts) succeed(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.clients, key)
+}
+
+// basicAuth checks the request's credentials against 'creds', locking out clients after repeated failures.
+// Requests without credentials, e.g. the browser's first one, don't count as failures.
+func (s *server) basicAuth(realm string, creds map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			client := s.limits.clientIP(r)
+			if d := s.logins.locked(client); s.limits.Enabled && d > 0 {
+				s.tooManyRequests(w, r, d)
+				return
+			}
+			user, pass, ok := r.BasicAuth()
+			if ok {
+				expected, known := creds[user]
+				// The password is compared even for unknown users, so timing doesn't reveal which ones exist
+				match := subtle.ConstantTimeCompare([]byte(pass), []byte(expected)) == 1
+				if known && match {
+					s.logins.succeed(client)
+					next.ServeHTTP(w, r)
+					return
+				}
+				if d := s.logins.fail(client, s.limits); s.limits.Enabled && d > 0 {
+					reqLogger(r).Warn("Locked out client after failed logins", "client", client, "lockout", d)
+					s.tooManyRequests(w, r, d)
+					return
+				}
+			}
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Basic realm="%s"`, realm))
+			w.WriteHeader(http.StatusUnauthorized)
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"github.com/aghdom/current/logging"
+)
+
+// ErrorData is passed to the error page templates.
+type ErrorData struct {
+	Status  int
+	Message string
+}
+
+// render executes the template 'name' with 'data' and writes it with the 'status' code.
+// The template is rendered into a buffer first, so a failing template results in a proper error page.
+func (s *server) render(w http.ResponseWriter, r *http.Request, status int, name string, data any) {
+	v := s.view.Load()
+	if v.err != nil {
+		renderDevError(w, v.err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := v.tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		logError(r, err)
+		if s.cfg.Dev {
+			renderDevError(w, err)
+			return
+		}
+		if name != "500" {
+			s.renderError(w, r, http.StatusInternalServerError, nil)
+		} else {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+}
+
+// renderError renders the error page for 'status'. If 'err' is not nil, it is logged along with the request ID.
+func (s *server) renderError(w http.ResponseWriter, r *http.Request, status int, err error) {
+	if err != nil {
+		logError(r, err)
+	}
+	// Error pages must never be cached as if they were the actual content
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Del("ETag")
+	w.Header().Del("Last-Modified")
+
+	// Statuses without a dedicated template use the generic one
+	name := "error"
+	switch status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusGone, http.StatusInternalServerError:
+		name = strconv.Itoa(status)
+	}
+	s.render(w, r, status, name, ErrorData{Status: status, Message: http.StatusText(status)})
+}
+
+func logError(r *http.Request, err error) {
+	reqLogger(r).Error("Request failed", "method", r.Method, "path", r.URL.Path, logging.Err(err))
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"encoding/xml"
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/search"
+)
+
+// sitemapPageSize is the number of posts listed in a single sitemap.
+// Once there are more posts, /sitemap.xml becomes a sitemap index.
+var sitemapPageSize = 10000
+
+// Meta holds the per-page metadata rendered into the "head" template.
+type Meta struct {
+	Title       string
+	Description string
+	Canonical   string
+	// Image is the URL of the page's Open Graph image, the site's default is used if empty
+	Image string
+	// Published is set for articles only, which also changes the Open Graph type
+	Published time.Time
+	// JSONLD is the structured data of the page, rendered as JSON
+	JSONLD any
+}
+
+// metaProvider is implemented by page data carrying their own metadata.
+type metaProvider interface {
+	PageMeta() *Meta
+}
+
+// pageMeta returns the metadata of the page 'data', or nil if it has none.
+func pageMeta(data any) *Meta {
+	if mp, ok := data.(metaProvider); ok {
+		return mp.PageMeta()
+	}
+	return nil
+}
+
+// pageSearchFeed returns the path of the search feed of the page 'data', or an empty string if it has none.
+func pageSearchFeed(data any) string {
+	if pd, ok := data.(PageData); ok {
+		return pd.SearchFeed
+	}
+	return ""
+}
+
+var (
+	tagRe    = regexp.MustCompile(`<[^>]*>`)
+	spacesRe = regexp.MustCompile(`\s+`)
+)
+
+// plainText renders the markdown in 'md' and strips it of all markup.
+func plainText(md []byte) string {
+	text := tagRe.ReplaceAllString(string(parseMd(md)), " ")
+	return strings.TrimSpace(spacesRe.ReplaceAllString(html.UnescapeString(text), " "))
+}
+
+// truncate shortens 's' to at most 'max' runes, cutting at a word boundary and adding an ellipsis.
+func truncate(s string, max int) string {
+	if utf8.RuneCountInString(s) <= max {
+		return s
+	}
+	runes := []rune(s)[:max-1]
+	if i := strings.LastIndex(string(runes), " "); i > 0 {
+		return strings.TrimRight(string(runes)[:i], " ,.;:") + "…"
+	}
+	return string(runes) + "…"
+}
+
+// postMeta builds the metadata of a single post page. The title is the first line of the post.
+func (s *server) postMeta(p data.Post) *Meta {
+	firstLine, _, _ := strings.Cut(strings.TrimSpace(string(p.Content)), "\n")
+	title := truncate(plainText([]byte(firstLine)), 70)
+	if title == "" {
+		title = p.Time.In(s.site.Location).Format("2006/01/02 15:04")
+	}
+	description := truncate(plainText(p.Content), 160)
+	canonical := s.site.URL(fmt.Sprintf("/posts/%d", p.Time.Unix()))
+
+	ld := map[string]any{
+		"@context":      "https://schema.org",
+		"@type":         "SocialMediaPosting",
+		"@id":           canonical,
+		"url":           canonical,
+		"headline":      title,
+		"articleBody":   plainText(p.Content),
+		"datePublished": p.LocalTime(s.site.Location).Format(time.RFC3339),
+	}
+	if s.site.Author.Name != "" {
+		author := map[string]any{"@type": "Person", "name": s.site.Author.Name}
+		if s.site.Author.URL != "" {
+			author["url"] = s.site.Author.URL
+		}
+		ld["author"] = author
+	}
+	return &Meta{
+		Title:       title,
+		Description: description,
+		Canonical:   canonical,
+		Image:       canonical + "/og.png",
+		Published:   p.Time,
+		JSONLD:      ld,
+	}
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+func writeXML(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	return enc.Encode(v)
+}
+
+// handleSitemap serves either a plain sitemap or, with too many posts to fit a single one, a sitemap index.
+func (s *server) handleSitemap(w http.ResponseWriter, r *http.Request) {
+	count, err := data.CountPosts(search.Query{})
+	if err != nil {
+		s.renderError(w, r, http.StatusInternalServerError, err)
+		return
+	}
+	if count <= sitemapPageSize {
+		s.writeSitemap(w, r, 0)
+		return
+	}
+
+	lastMod := lastModified().Format(time.RFC3339)
+	idx := sitemapIndex{Sitemaps: []sitemapURL{{Loc: s.site.URL("/sitemap-pages.xml"), LastMod: lastMod}}}
+	for page := 1; (page-1)*sitemapPageSize < count; page++ {
+		idx.Sitemaps = append(idx.Sitemaps, sitemapURL{
+			Loc:     s.site.URL(fmt.Sprintf("/sitemap-posts-%d.xml", page)),
+			LastMod: lastMod,
+		})
+	}
+	if err := writeXML(w, idx); err != nil {
+		logError(r, err)
+	}
+}
+
+func (s *server) handleSitemapPages(w http.ResponseWriter, r *http.Request) {
+	s.writeSitemap(w, r, -1)
+}
+
+func (s *server) handleSitemapPosts(w http.ResponseWriter, r *http.Request) {
+	page, err := strconv.Atoi(chi.URLParam(r, "page"))
+	if err != nil || page < 1 {
+		s.renderError(w, r, http.StatusNotFound, nil)
+		return
+	}
+	s.writeSitemap(w, r, page)
+}
+
+// writeSitemap writes a sitemap with the static pages and/or a page of posts.
+// A 'page' of 0 means both the static pages and all posts, -1 only the static pages.
+func (s *server) writeSitemap(w http.ResponseWriter, r *http.Request, page int) {
+	var set sitemapURLSet
+	if page <= 0 {
+		lastMod := lastModified().Format(time.RFC3339)
+		for _, p := range []string{"/", "/about", "/archive"} {
+			set.URLs = append(set.URLs, sitemapURL{Loc: s.site.URL(p), LastMod: lastMod})
+		}
+	}
+	if page >= 0 {
+		postPage := page
+		if postPage == 0 {
+			postPage = 1
+		}
+		times, err := data.GetPostTimes(postPage, sitemapPageSize)
+		if err != nil {
+			s.renderError(w, r, http.StatusInternalServerError, err)
+			return
+		}
+		if page > 1 && len(times) == 0 {
+			s.renderError(w, r, http.StatusNotFound, nil)
+			return
+		}
+		for _, t := range times {
+			set.URLs = append(set.URLs, sitemapURL{
+				Loc:     s.site.URL(fmt.Sprintf("/posts/%d", t.Unix())),
+				LastMod: t.Format(time.RFC3339),
+			})
+		}
+	}
+	if err := writeXML(w, set); err != nil {
+		logError(r, err)
+	}
+}
+
+// handleRobots serves the robots.txt from "robots.file" if configured, or generates one otherwise.
+func (s *server) handleRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if s.robots != nil {
+		w.Write(s.robots)
+		return
+	}
+	var b strings.Builder
+	b.WriteString("User-agent: *\n")
+	disallow := viper.GetStringSlice("robots.disallow")
+	if len(disallow) == 0 {
+		b.WriteString("Disallow:\n")
+	}
+	for _, d := range disallow {
+		b.WriteString("Disallow: " + d + "\n")
+	}
+	b.WriteString("\nSitemap: " + s.site.URL("/sitemap.xml") + "\n")
+	w.Write([]byte(b.String()))
+}
@@ -1,254 +1,405 @@
 package server
 
 import (
-	"embed"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
 	"io/fs"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/gomarkdown/markdown"
 	"github.com/spf13/viper"
 
 	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/render"
+	"github.com/aghdom/current/site"
 )
 
 type ServerConfig struct {
-	Host          string
-	Port          int
-	AdminUsername string
-	AdminPassword string
+	Host            string
+	Port            int
+	AdminUsername   string
+	AdminPassword   string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	MaxHeaderBytes  int
+	ShutdownTimeout time.Duration
+	// Dev enables development mode, where the theme is read from DevDir and reloaded on changes
+	Dev    bool
+	DevDir string
 }
 
 type FeedPost struct {
-	Date    string
-	Time    string
+	// Date and Time are shown in the site's timezone
+	Date string
+	Time string
+	// Datetime is the RFC 3339 creation time at the author's UTC offset
+	Datetime string
+	// Local is the author's local time, if it differs from the site's
+	Local   string
 	Unix    int64
 	Content template.HTML
+	Preview *data.LinkPreview
+}
+
+type AboutData struct {
+	About template.HTML
 }
 
 type PageData struct {
 	Title    string
 	SubTitle string
 	Search   bool
-	Feed     []FeedPost
-	PrevPage int
-	NextPage int
+	// Query is the search shown in the search form and kept across pages
+	Query string
+	// SearchFeed is the path of the Atom feed of the search
+	SearchFeed string
+	Feed       []FeedPost
+	// Newer and Older link to the neighbouring pages of the timeline
+	Newer string
+	Older string
+	// Prev and Next link to the neighbouring periods of archive pages
+	Prev *NavLink
+	Next *NavLink
+	Meta *Meta
+	// Live enables the live updates of the feed
+	Live bool
+}
+
+func (pd PageData) PageMeta() *Meta {
+	return pd.Meta
 }
 
-func initConfig() ServerConfig {
+func initConfig() (ServerConfig, error) {
 	cfg := ServerConfig{
-		Host:          viper.GetString("server.host"),
-		Port:          viper.GetInt("server.port"),
-		AdminUsername: viper.GetString("server.admin_user"),
-		AdminPassword: viper.GetString("server.admin_pass"),
+		Host:            viper.GetString("server.host"),
+		Port:            viper.GetInt("server.port"),
+		AdminUsername:   viper.GetString("server.admin_user"),
+		AdminPassword:   viper.GetString("server.admin_pass"),
+		ReadTimeout:     viper.GetDuration("server.read_timeout"),
+		WriteTimeout:    viper.GetDuration("server.write_timeout"),
+		IdleTimeout:     viper.GetDuration("server.idle_timeout"),
+		MaxHeaderBytes:  viper.GetInt("server.max_header_bytes"),
+		ShutdownTimeout: viper.GetDuration("server.shutdown_timeout"),
+		Dev:             viper.GetBool("server.dev"),
+		DevDir:          viper.GetString("server.dev_dir"),
 	}
 	if cfg.AdminPassword == "" || cfg.AdminUsername == "" {
-		log.Fatal("Missing admin credentials!")
+		return cfg, errors.New("missing admin credentials")
 	}
-	return cfg
+	return cfg, nil
 }
 
 func parseMd(md []byte) []byte {
-	md = markdown.NormalizeNewlines(md)
-
-	// exts := parser.CommonExtensions // parser.OrderedListStart | parser.NoEmptyLineBeforeBlock
-	// p := parser.NewWithExtensions(exts)
-
-	return markdown.ToHTML(md, nil, nil)
+	return render.Markdown(md)
 }
 
-func transformPost(post data.Post) FeedPost {
-	return FeedPost{
-		Date:    post.Time.Format("2006/01/02"),
-		Time:    post.Time.Format("15:04"),
-		Unix:    post.Time.Unix(),
-		Content: template.HTML(parseMd(post.Content)),
+func (s *server) transformPost(post data.Post) FeedPost {
+	tm := post.Time.In(s.site.Location)
+	local := post.LocalTime(s.site.Location)
+	fp := FeedPost{
+		Date:     tm.Format("2006/01/02"),
+		Time:     tm.Format("15:04"),
+		Datetime: local.Format(time.RFC3339),
+		Unix:     post.Time.Unix(),
+		Content:  template.HTML(parseMd(post.Content)),
+		Preview:  post.Preview,
+	}
+	if _, siteOffset := tm.Zone(); post.Offset != nil && *post.Offset != siteOffset {
+		fp.Local = local.Format("2006/01/02 15:04 UTC-07:00")
 	}
+	return fp
 }
 
-//go:embed static/*
-var staticFS embed.FS
-
 func getAdminCreds(cfg ServerConfig) map[string]string {
 	return map[string]string{cfg.AdminUsername: cfg.AdminPassword}
 }
 
-func Run() {
-	cfg := initConfig()
-	r := chi.NewRouter()
-	tmpl := template.Must(template.ParseGlob("templates/*"))
+// server holds the state shared by all the request handlers.
+type server struct {
+	cfg   ServerConfig
+	site  site.Config
+	theme fs.FS
+	// view is swapped for a freshly loaded one, whenever the theme changes in development mode
+	view atomic.Pointer[view]
+	// robots holds the custom robots.txt, if one is configured
+	robots []byte
+	reload *reloader
+	og     ogCache
+	// metrics configures the Prometheus endpoint
+	metrics MetricsConfig
+	health  HealthConfig
+	limits  RateLimitConfig
+	logins  lockouts
+	websub  WebSubConfig
+	// websubPending is set while publishing the feeds is scheduled, so that bursts of changes are coalesced
+	websubPending atomic.Bool
+	// events fans out changed posts to the live timelines, nil if disabled
+	events *broker
+}
+
+// Run starts serving the application and blocks until the server is shut down.
+// On SIGINT or SIGTERM it stops accepting new connections and waits up to the configured
+// grace period for in-flight requests and background jobs to finish.
+func Run() error {
+	cfg, err := initConfig()
+	if err != nil {
+		return err
+	}
+	// In development mode, the default theme is read from disk instead of the embedded copy
+	var base fs.FS = defaultTheme
+	if cfg.Dev {
+		base = os.DirFS(cfg.DevDir)
+	}
+	theme, err := themeFS(viper.GetString("theme.dir"), base)
+	if err != nil {
+		return err
+	}
+	siteCfg, err := site.Load()
+	if err != nil {
+		return err
+	}
+	if err := render.Configure(); err != nil {
+		return err
+	}
+	s := &server{
+		cfg:     cfg,
+		site:    siteCfg,
+		theme:   theme,
+		metrics: initMetricsConfig(),
+		health:  initHealthConfig(),
+		websub:  initWebSubConfig(),
+	}
+	if s.limits, err = initRateLimitConfig(); err != nil {
+		return err
+	}
+	if fp := viper.GetString("robots.file"); fp != "" {
+		if s.robots, err = os.ReadFile(fp); err != nil {
+			return fmt.Errorf("reading robots.txt: %w", err)
+		}
+	}
+	v := s.loadView()
+	if v.err != nil && !cfg.Dev {
+		return v.err
+	}
+	s.view.Store(v)
+	if cfg.Dev {
+		s.reload = newReloader()
+		if err := s.watchTheme([]string{viper.GetString("theme.dir"), cfg.DevDir}); err != nil {
+			return err
+		}
+	}
 	// TODO: This should be refactored to be only called once and not on every startup
-	data.InitDB()
+	if err := data.InitDB(); err != nil {
+		return fmt.Errorf("initializing DB: %w", err)
+	}
+	if ec := initEventsConfig(); ec.Enabled {
+		s.events = newBroker(ec)
+		data.OnChange(s.publishChange)
+	}
+	if s.websub.enabled() {
+		data.OnChange(s.publishFeeds)
+	}
+
+	srv := &http.Server{
+		Addr:           net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.Port)),
+		Handler:        s.routes(),
+		ReadTimeout:    cfg.ReadTimeout,
+		WriteTimeout:   cfg.WriteTimeout,
+		IdleTimeout:    cfg.IdleTimeout,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
+	if s.reload != nil {
+		srv.RegisterOnShutdown(s.reload.close)
+	}
+	if s.events != nil {
+		srv.RegisterOnShutdown(s.events.close)
+	}
+	// Federation jobs are worked on until shutdown, after which the one in progress is drained with the other background jobs
+	outboxCtx, stopOutbox := context.WithCancel(context.Background())
+	data.RunBackground(func() { data.RunOutbox(outboxCtx) })
+	srv.RegisterOnShutdown(stopOutbox)
+	servers := []*http.Server{srv}
+	if s.metrics.Enabled && s.metrics.Addr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.handleMetrics())
+		servers = append(servers, &http.Server{
+			Addr:              s.metrics.Addr,
+			Handler:           mux,
+			ReadHeaderTimeout: cfg.ReadTimeout,
+		})
+	}
+	return serve(cfg.ShutdownTimeout, servers...)
+}
+
+func (s *server) routes() http.Handler {
+	r := chi.NewRouter()
 
 	// Register middleware
 	r.Use(middleware.RequestID)
+	r.Use(accessLog)
+	r.Use(instrument)
 	r.Use(middleware.Recoverer)
 
-	r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-		var pageNum int64
-		var err error
-		query := r.URL.Query().Get("q")
-		pArg := r.URL.Query().Get("p")
-		if pArg == "" {
-			pageNum = 1
-		} else {
-			pageNum, err = strconv.ParseInt(pArg, 10, 0)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			if pageNum < 1 {
-				pageNum = 1
-			}
-		}
-		pd := PageData{
-			Title:    "current",
-			SubTitle: "my personal micro-blog",
-			Search:   true,
-			PrevPage: int(pageNum) - 1,
-		}
-		if query != "" {
-			pd.Title = fmt.Sprintf("Search '%s'", query)
-		}
-		postCount := data.CountPosts(query)
-		if postCount > int(pageNum)*10 {
-			pd.NextPage = int(pageNum) + 1
-		}
-		posts := data.GetPosts(int(pageNum), 10, query)
-		for _, p := range posts {
-			pd.Feed = append(pd.Feed, transformPost(p))
-		}
-		tmpl.ExecuteTemplate(w, "index", pd)
-	})
-
-	r.Get("/about", func(w http.ResponseWriter, r *http.Request) {
-		tmpl.ExecuteTemplate(w, "about", nil)
-	})
-
-	r.Get("/posts/{timestamp}", func(w http.ResponseWriter, r *http.Request) {
-		var tm time.Time
-		ts := chi.URLParam(r, "timestamp")
-		if ts != "" {
-			unix, err := strconv.ParseInt(ts, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			tm = time.Unix(unix, 0).UTC()
-		}
-		p, ok := data.GetPostByTime(tm)
-		if !ok {
-			//TODO: Implement better 404 handling
-			tmpl.ExecuteTemplate(w, "index", PageData{Title: "Post not found!"})
-			return
-		}
-		pd := PageData{
-			Title: p.Time.Format("2006/01/02 15:04"),
-			Feed:  []FeedPost{transformPost(p)},
-		}
-		tmpl.ExecuteTemplate(w, "index", pd)
+	// health checks
+	r.Group(func(r chi.Router) {
+		r.Use(noStore)
+		r.Get("/healthz", s.handleHealthz)
+		r.Get("/readyz", s.handleReadyz)
 	})
 
-	r.Get("/on/{year}/{month}/{day}", func(w http.ResponseWriter, r *http.Request) {
-		var year, month, day int64
-		var err error
-		y, m, d := chi.URLParam(r, "year"), chi.URLParam(r, "month"), chi.URLParam(r, "day")
+	// all public requests share the same bucket per client
+	public := s.rateLimit(s.limits.Public, nil)
+	// searches run a full scan of the posts, so they are limited further, by a bucket shared by the pages and the feed
+	searches := s.rateLimit(s.limits.Search, isSearch)
 
-		if y != "" {
-			year, err = strconv.ParseInt(y, 10, 0)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-		}
-		if m != "" {
-			month, err = strconv.ParseInt(m, 10, 0)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-		}
-		if d != "" {
-			day, err = strconv.ParseInt(d, 10, 0)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-		}
+	// In development mode the theme changes without the posts doing so, so pages mustn't be revalidated against them
+	cached := conditional
+	if s.cfg.Dev {
+		cached = func(time.Duration) func(http.Handler) http.Handler { return noStore }
+	}
 
-		tm := time.Date(int(year), time.Month(month), int(day), 0, 0, 0, 0, time.UTC)
-		pd := PageData{
-			Title: "Posts on " + tm.Format("2006/01/02"),
-		}
-		posts := data.GetPostOnDate(tm)
-		for _, p := range posts {
-			pd.Feed = append(pd.Feed, transformPost(p))
-		}
-		tmpl.ExecuteTemplate(w, "index", pd)
+	// public pages
+	r.Group(func(r chi.Router) {
+		r.Use(public)
+		r.Use(searches)
+		r.Use(cached(time.Minute))
+		r.Get("/", s.handleIndex)
+		r.Get("/about", s.handleAbout)
+		r.Get("/posts/{timestamp}", s.handlePost)
+		r.Get("/posts/{timestamp}/og.png", s.handlePostImage)
+		r.Get("/on/{year}", s.handleOnYear)
+		r.Get("/on/{year}/{month}", s.handleOnMonth)
+		r.Get("/on/{year}/{month}/{day}", s.handleOnDate)
+		r.Get("/archive", s.handleArchive)
+		r.Get("/sitemap.xml", s.handleSitemap)
+		r.Get("/sitemap-pages.xml", s.handleSitemapPages)
+		r.Get("/sitemap-posts-{page}.xml", s.handleSitemapPosts)
+		r.Get("/robots.txt", s.handleRobots)
 	})
 
+	// live timeline updates, streamed for as long as the client stays connected
+	if s.events != nil {
+		r.With(public).Get("/events", s.handleEvents)
+	}
+
 	// alternate feeds
-	r.Get("/current.atom", func(w http.ResponseWriter, r *http.Request) {
-		feed := data.GetAtomFeed()
-		w.Header().Add("Content-Type", "application/atom+xml")
-		w.Write(feed)
-	})
-	r.Get("/index.xml", func(w http.ResponseWriter, r *http.Request) {
-		feed := data.GetRssFeed()
-		w.Header().Add("Content-Type", "application/rss+xml")
-		w.Write(feed)
-	})
-	r.Get("/index.json", func(w http.ResponseWriter, r *http.Request) {
-		feed := data.GetJsonFeed()
-		w.Header().Add("Content-Type", "application/json")
-		w.Write(feed)
+	r.Group(func(r chi.Router) {
+		r.Use(public)
+		r.Use(cached(5 * time.Minute))
+		r.Get("/current.atom", s.handleFeed(data.GetAtomFeed, "application/atom+xml"))
+		r.Get("/index.xml", s.handleFeed(data.GetRssFeed, "application/rss+xml"))
+		r.Get("/index.json", s.handleFeed(data.GetJsonFeed, "application/json"))
+		r.With(searches).Get(data.SearchPath, s.handleSearchFeed)
 	})
 
+	// built-in WebSub hub
+	if s.websub.Hub {
+		r.Group(func(r chi.Router) {
+			r.Use(noStore)
+			r.Use(public)
+			r.Post(data.HubPath, s.handleHub)
+		})
+	}
+
 	// admin endpoints
 	r.Group(func(r chi.Router) {
-		r.Use(middleware.BasicAuth("author", getAdminCreds(cfg)))
-		r.Get("/author", func(w http.ResponseWriter, r *http.Request) {
-			tmpl.ExecuteTemplate(w, "author", nil)
-		})
+		r.Use(noStore)
+		r.Use(s.rateLimit(s.limits.Admin, nil))
+		r.Use(s.basicAuth("author", getAdminCreds(s.cfg)))
+		r.Get("/author", s.handleAuthor)
+		r.Post("/author/post", s.handleAuthorPost)
+		r.Post("/author/delete", s.handleAuthorDelete)
+		r.Post("/author/federate", s.handleAuthorFederate)
+		r.Post("/author/outbox/retry", s.handleAuthorRetry)
+		r.Post("/author/preview", s.handleAuthorPreview)
+		r.Get("/author/edit/{timestamp}", s.handleAuthorEdit)
+		r.Post("/author/edit/{timestamp}", s.handleAuthorUpdate)
+	})
 
-		r.Post("/author/post", func(w http.ResponseWriter, r *http.Request) {
-			bskyFed := r.FormValue("bsky_fed") == "on"
-			data.CreatePost(r.FormValue("content"), bskyFed) // Should empty content be allowed?
-			// Redirect back to the admin portal
-			w.Header().Add("Location", "/author")
-			w.WriteHeader(http.StatusSeeOther)
-		})
+	// serve embedded static files
+	r.Handle("/s/*", http.StripPrefix("/s/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v := s.view.Load()
+		// Static files are missing, if they failed to load during a reload in development mode
+		if v.static == nil {
+			renderDevError(w, v.err)
+			return
+		}
+		v.static.ServeHTTP(w, r)
+	})))
 
-		r.Post("/author/delete", func(w http.ResponseWriter, r *http.Request) {
-			bskyDel := r.FormValue("bsky_del") == "on"
-			ts, err := strconv.ParseInt(r.FormValue("time"), 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			tm := time.Unix(int64(ts), 0).UTC()
-			data.DeletePostByTime(tm, bskyDel)
-			// Redirect back to the admin portal
-			w.Header().Add("Location", "/author")
-			w.WriteHeader(http.StatusSeeOther)
-		})
+	if s.cfg.Dev {
+		r.Get("/_dev/reload", s.handleReload)
+	}
+
+	// metrics are served here, unless they have a listen address of their own
+	if s.metrics.Enabled && s.metrics.Addr == "" {
+		r.Handle("/metrics", s.handleMetrics())
+	}
+
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		s.renderError(w, r, http.StatusNotFound, nil)
 	})
+	return r
+}
 
-	// serve embedded static files
-	sFS, err := fs.Sub(staticFS, "static")
-	if err != nil {
-		log.Fatal(err)
+// serve runs 'servers' until one of them fails or a termination signal is received, after which they are gracefully shut down.
+func serve(grace time.Duration, servers ...*http.Server) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		ln, err := net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return err
+		}
+		listeners[i] = ln
+		slog.Info("Listening", "addr", ln.Addr().String())
+	}
+
+	errCh := make(chan error, len(servers))
+	for i, srv := range servers {
+		go func(srv *http.Server, ln net.Listener) {
+			errCh <- srv.Serve(ln)
+		}(srv, listeners[i])
 	}
-	fs := http.FileServer(http.FS(sFS))
-	r.Handle("/s/*", http.StripPrefix("/s/", fs))
 
-	addr := fmt.Sprintf(":%d", cfg.Port)
-	fmt.Println("Listening on " + addr)
-	http.ListenAndServe(addr, r)
+	var serveErr error
+	select {
+	case serveErr = <-errCh:
+	case <-ctx.Done():
+	}
+	// Restore default signal handling, so a second signal kills the process immediately
+	stop()
+	slog.Info("Shutting down")
+
+	sCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(sCtx); err != nil {
+			return fmt.Errorf("server shutdown: %w", err)
+		}
+	}
+	if serveErr != nil {
+		return serveErr
+	}
+	if err := data.WaitBackground(sCtx); err != nil {
+		return fmt.Errorf("waiting for background jobs: %w", err)
+	}
+	return nil
 }
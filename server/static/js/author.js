@@ -0,0 +1,41 @@
+// Live preview of the composer, rendered by the server the same way as published posts
+for (const textarea of document.querySelectorAll("textarea[data-preview]")) {
+    const preview = document.getElementById(textarea.dataset.preview);
+    let timer;
+    const update = async () => {
+        const res = await fetch("/author/preview", {
+            method: "POST",
+            body: new URLSearchParams({ content: textarea.value }),
+        });
+        if (res.ok) {
+            preview.innerHTML = await res.text();
+        }
+    };
+    textarea.addEventListener("input", () => {
+        clearTimeout(timer);
+        timer = setTimeout(update, 300);
+    });
+    if (textarea.value) {
+        update();
+    }
+}
+
+// The author's UTC offset, so the post can show the local time it was written at
+for (const input of document.querySelectorAll("input[data-utc-offset]")) {
+    input.value = -new Date().getTimezoneOffset() * 60;
+}
+
+// Bulk selection
+const selectAll = document.querySelector(".select-all");
+if (selectAll) {
+    const boxes = document.querySelectorAll('input[name="time"][form="bulk"]');
+    selectAll.addEventListener("change", () => boxes.forEach((b) => (b.checked = selectAll.checked)));
+}
+
+for (const button of document.querySelectorAll("button[data-confirm]")) {
+    button.addEventListener("click", (e) => {
+        if (!confirm(button.dataset.confirm)) {
+            e.preventDefault();
+        }
+    });
+}
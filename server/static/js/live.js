@@ -0,0 +1,35 @@
+// Live updates of the timeline, streamed by the server as posts are created, edited or deleted
+const feed = document.querySelector(".feed[data-live]");
+if (feed && window.EventSource) {
+    const events = new EventSource(feed.dataset.live);
+    const fragment = (html) => {
+        const tpl = document.createElement("template");
+        tpl.innerHTML = html.trim();
+        return tpl.content.firstElementChild;
+    };
+    const unixOf = (el) => Number(el.id.replace("post-", ""));
+
+    events.addEventListener("created", (e) => {
+        const post = JSON.parse(e.data);
+        if (document.getElementById("post-" + post.unix)) {
+            return;
+        }
+        // Keep the feed ordered from the newest, posts older than the whole page belong on the next one
+        const next = [...feed.querySelectorAll(".post")].find((el) => unixOf(el) < post.unix);
+        if (next) {
+            feed.insertBefore(fragment(post.html), next);
+        } else if (!feed.querySelector(".post")) {
+            feed.appendChild(fragment(post.html));
+        }
+    });
+    events.addEventListener("updated", (e) => {
+        const post = JSON.parse(e.data);
+        document.getElementById("post-" + post.unix)?.replaceWith(fragment(post.html));
+    });
+    events.addEventListener("deleted", (e) => {
+        const post = JSON.parse(e.data);
+        document.getElementById("post-" + post.unix)?.remove();
+    });
+    // Too many updates were missed while disconnected to catch up on
+    events.addEventListener("reset", () => location.reload());
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aghdom/current/site"
+)
+
+// defaultTheme holds the templates, static files and Open Graph card layout compiled into the binary.
+//
+//go:embed templates static og
+var defaultTheme embed.FS
+
+// overlayFS is a file system, where files in 'upper' take precedence over the ones with the same name in 'lower'.
+// Directory listings are merged, so both file systems appear as one.
+type overlayFS struct {
+	upper, lower fs.FS
+}
+
+func (o overlayFS) Open(name string) (fs.File, error) {
+	f, err := o.upper.Open(name)
+	// Only missing files fall back, other errors of an override mustn't silently serve the default
+	if errors.Is(err, fs.ErrNotExist) {
+		return o.lower.Open(name)
+	}
+	return f, err
+}
+
+func (o overlayFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries := map[string]fs.DirEntry{}
+	lower, lErr := fs.ReadDir(o.lower, name)
+	for _, e := range lower {
+		entries[e.Name()] = e
+	}
+	upper, uErr := fs.ReadDir(o.upper, name)
+	for _, e := range upper {
+		entries[e.Name()] = e
+	}
+	if lErr != nil && uErr != nil {
+		return nil, lErr
+	}
+
+	result := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name() < result[j].Name() })
+	return result, nil
+}
+
+// themeFS returns the file system of the theme on top of 'base'. If 'dir' is set, its "templates",
+// "static" and "og" sub-directories override the corresponding files of 'base'.
+func themeFS(dir string, base fs.FS) (fs.FS, error) {
+	if dir == "" {
+		return base, nil
+	}
+	if _, err := os.Stat(dir); err != nil {
+		return nil, fmt.Errorf("theme directory: %w", err)
+	}
+	return overlayFS{upper: os.DirFS(dir), lower: base}, nil
+}
+
+// view holds the parsed templates and the static assets of the theme.
+type view struct {
+	tmpl   *template.Template
+	static *assets
+	og     *ogCard
+	// err holds the error of loading the theme, which is shown in place of pages in development mode
+	err error
+}
+
+// loadView parses the templates and fingerprints the static files of the server's theme.
+func (s *server) loadView() *view {
+	v := &view{}
+	sFS, err := fs.Sub(s.theme, "static")
+	if err == nil {
+		v.static, err = newAssets(sFS)
+	}
+	if err != nil {
+		v.err = fmt.Errorf("loading static files: %w", err)
+		return v
+	}
+	funcs := template.FuncMap{
+		"static":     v.static.URL,
+		"site":       func() site.Config { return s.site },
+		"meta":       pageMeta,
+		"searchFeed": pageSearchFeed,
+		"dev":        func() bool { return s.cfg.Dev },
+	}
+	if v.tmpl, err = template.New("").Funcs(funcs).ParseFS(s.theme, "templates/*.html"); err != nil {
+		v.err = fmt.Errorf("parsing templates: %w", err)
+		return v
+	}
+	if v.og, err = loadOGCard(s.theme); err != nil {
+		v.err = fmt.Errorf("loading Open Graph card: %w", err)
+	}
+	return v
+}
+
+// ExportTheme copies the default templates and static files into 'dir', so they can be customised
+// and used as the theme directory. Existing files are only overwritten if 'force' is set.
+// The path of every exported file is written to 'out'.
+func ExportTheme(dir string, force bool, out io.Writer) error {
+	return fs.WalkDir(defaultTheme, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if d.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		if _, err := os.Stat(target); err == nil && !force {
+			return fmt.Errorf("%s already exists, use --force to overwrite it", target)
+		} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		content, err := defaultTheme.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(target, content, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Exported "+target)
+		return nil
+	})
+}
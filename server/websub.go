@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/logging"
+)
+
+// WebSubConfig configures the publishing of the feeds over WebSub.
+type WebSubConfig struct {
+	// Hubs are the external hubs notified of changes to the feeds
+	Hubs []string
+	// Hub enables the built-in hub
+	Hub bool
+	// Lease is granted to subscribers which don't request one, MaxLease is the longest one granted
+	Lease    time.Duration
+	MaxLease time.Duration
+	// Timeout bounds a single publishing run to all the hubs and subscribers
+	Timeout time.Duration
+}
+
+func initWebSubConfig() WebSubConfig {
+	cfg := WebSubConfig{
+		Hubs:     viper.GetStringSlice("websub.hubs"),
+		Hub:      viper.GetBool("websub.hub.enabled"),
+		Lease:    viper.GetDuration("websub.hub.lease"),
+		MaxLease: viper.GetDuration("websub.hub.max_lease"),
+		Timeout:  viper.GetDuration("websub.publish_timeout"),
+	}
+	if cfg.MaxLease < cfg.Lease {
+		cfg.MaxLease = cfg.Lease
+	}
+	return cfg
+}
+
+// enabled reports whether there is anywhere to publish the feeds to.
+func (c WebSubConfig) enabled() bool {
+	return c.Hub || len(c.Hubs) > 0
+}
+
+// maxSecretLen is the limit on hub.secret set by the WebSub spec.
+const maxSecretLen = 200
+
+// publishFeeds notifies the hubs of a change to the feeds, in the background.
+func (s *server) publishFeeds(data.Change) {
+	if s.websubPending.Swap(true) {
+		return
+	}
+	data.RunBackground(func() {
+		// Changes made from now on need another run
+		s.websubPending.Store(false)
+		ctx, cancel := context.WithTimeout(context.Background(), s.websub.Timeout)
+		defer cancel()
+		if len(s.websub.Hubs) > 0 {
+			data.PingHubs(ctx, s.site)
+		}
+		if s.websub.Hub {
+			data.DistributeFeeds(ctx, s.site)
+		}
+	})
+}
+
+// handleHub serves the subscription requests of the built-in WebSub hub. Requests are validated right away,
+// the intent of the subscriber is verified in the background.
+func (s *server) handleHub(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+	mode := r.PostForm.Get("hub.mode")
+	callback := r.PostForm.Get("hub.callback")
+	topic := r.PostForm.Get("hub.topic")
+	secret := r.PostForm.Get("hub.secret")
+
+	if mode != "subscribe" && mode != "unsubscribe" {
+		http.Error(w, "hub.mode must be subscribe or unsubscribe", http.StatusBadRequest)
+		return
+	}
+	if u, err := url.Parse(callback); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		http.Error(w, "hub.callback must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	if len(secret) >= maxSecretLen {
+		http.Error(w, "hub.secret is too long", http.StatusBadRequest)
+		return
+	}
+	lease := s.websub.Lease
+	if ls := r.PostForm.Get("hub.lease_seconds"); ls != "" {
+		secs, err := strconv.Atoi(ls)
+		if err != nil || secs < 1 {
+			http.Error(w, "invalid hub.lease_seconds", http.StatusBadRequest)
+			return
+		}
+		lease = min(time.Duration(secs)*time.Second, s.websub.MaxLease)
+	}
+
+	_, known := data.FeedTopic(s.site, topic)
+	log := reqLogger(r).With("callback", callback, "topic", topic)
+	w.WriteHeader(http.StatusAccepted)
+
+	data.RunBackground(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), s.websub.Timeout)
+		defer cancel()
+		if !known {
+			log.Info("Denied WebSub subscription to unknown topic")
+			if err := data.DenySubscription(ctx, callback, topic, "unknown topic"); err != nil {
+				log.Warn("Failed to deny WebSub subscription", logging.Err(err))
+			}
+			return
+		}
+		if err := data.VerifyIntent(ctx, callback, mode, topic, lease); err != nil {
+			log.Warn("Failed to verify WebSub intent", "mode", mode, logging.Err(err))
+			return
+		}
+		var err error
+		if mode == "subscribe" {
+			err = data.SaveSubscription(data.Subscription{Callback: callback, Topic: topic, Secret: secret, Expires: time.Now().Add(lease)})
+		} else {
+			err = data.DeleteSubscription(callback, topic)
+		}
+		if err != nil {
+			log.Error("Failed to store WebSub subscription", logging.Err(err))
+			return
+		}
+		log.Info("Verified WebSub intent", "mode", mode, slog.Duration("lease", lease))
+	})
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/aghdom/current/data"
+	"github.com/aghdom/current/site"
+)
+
+// newHubServer returns a server with the built-in hub, backed by a new DB and allowed to reach local subscribers.
+func newHubServer(t *testing.T) *server {
+	t.Cleanup(viper.Reset)
+	viper.Set("sqlite.filepath", filepath.Join(t.TempDir(), "current.db"))
+	viper.Set("websub.timeout", 5*time.Second)
+	viper.Set("websub.hub.allow_private", true)
+	if err := data.InitDB(); err != nil {
+		t.Fatalf("InitDB: %v", err)
+	}
+	return &server{
+		site:   site.Config{BaseURL: "https://example.com"},
+		websub: WebSubConfig{Hub: true, Lease: time.Hour, MaxLease: 2 * time.Hour, Timeout: 5 * time.Second},
+	}
+}
+
+// subscribe sends a subscription request to the hub and waits for the intent to be verified.
+func subscribe(t *testing.T, s *server, form url.Values) {
+	req := httptest.NewRequest(http.MethodPost, data.HubPath, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec := httptest.NewRecorder()
+	s.handleHub(rec, req)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("hub responded with %d: %s", rec.Code, rec.Body)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := data.WaitBackground(ctx); err != nil {
+		t.Fatalf("verification of intent didn't finish: %v", err)
+	}
+}
+
+func TestHubSubscribe(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// lease is the requested hub.lease_seconds, if not empty
+		lease     string
+		wrong     bool
+		wantLease time.Duration
+	}{
+		{name: "default lease", wantLease: time.Hour},
+		{name: "requested lease", lease: "5400", wantLease: 90 * time.Minute},
+		{name: "lease capped at MaxLease", lease: "31536000", wantLease: 2 * time.Hour},
+		{name: "wrong challenge", wrong: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newHubServer(t)
+			topic := s.site.URL("/current.atom")
+			var verifiedLease string
+			sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				verifiedLease = r.URL.Query().Get("hub.lease_seconds")
+				challenge := r.URL.Query().Get("hub.challenge")
+				if tc.wrong {
+					challenge = strings.ToUpper(challenge) + "x"
+				}
+				fmt.Fprint(w, challenge)
+			}))
+			t.Cleanup(sub.Close)
+
+			form := url.Values{"hub.mode": {"subscribe"}, "hub.callback": {sub.URL}, "hub.topic": {topic}, "hub.secret": {"s3cret"}}
+			if tc.lease != "" {
+				form.Set("hub.lease_seconds", tc.lease)
+			}
+			subscribe(t, s, form)
+
+			subs, err := data.Subscriptions(topic)
+			if err != nil {
+				t.Fatalf("Subscriptions: %v", err)
+			}
+			if tc.wrong {
+				if len(subs) != 0 {
+					t.Errorf("subscriptions = %+v, want none after a wrong challenge", subs)
+				}
+				return
+			}
+			if len(subs) != 1 || subs[0].Callback != sub.URL || subs[0].Secret != "s3cret" {
+				t.Fatalf("subscriptions = %+v, want one of %s with its secret", subs, sub.URL)
+			}
+			if want := fmt.Sprint(int(tc.wantLease.Seconds())); verifiedLease != want {
+				t.Errorf("verified hub.lease_seconds = %s, want %s", verifiedLease, want)
+			}
+			if d := time.Until(subs[0].Expires) - tc.wantLease; d < -5*time.Second || d > 5*time.Second {
+				t.Errorf("subscription expires in %v, want %v", time.Until(subs[0].Expires), tc.wantLease)
+			}
+		})
+	}
+}
+
+func TestHubUnsubscribe(t *testing.T) {
+	s := newHubServer(t)
+	topic := s.site.URL("/current.atom")
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Query().Get("hub.challenge"))
+	}))
+	t.Cleanup(sub.Close)
+
+	subscribe(t, s, url.Values{"hub.mode": {"subscribe"}, "hub.callback": {sub.URL}, "hub.topic": {topic}})
+	subscribe(t, s, url.Values{"hub.mode": {"unsubscribe"}, "hub.callback": {sub.URL}, "hub.topic": {topic}})
+	subs, err := data.Subscriptions(topic)
+	if err != nil {
+		t.Fatalf("Subscriptions: %v", err)
+	}
+	if len(subs) != 0 {
+		t.Errorf("subscriptions = %+v, want none after unsubscribing", subs)
+	}
+}
@@ -0,0 +1,90 @@
+package site
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	// The zone database is embedded, as the deployed image might not have one
+	_ "time/tzdata"
+
+	"github.com/spf13/viper"
+)
+
+// Author identifies the person behind the site.
+type Author struct {
+	Name  string
+	Email string
+	URL   string
+}
+
+// Link is an entry in the site's footer navigation.
+type Link struct {
+	Name string
+	URL  string
+}
+
+// Config describes the identity of the site, as configured in the "site" section.
+type Config struct {
+	Title       string
+	Description string
+	// BaseURL is the absolute URL the site is served on, without a trailing slash
+	BaseURL string
+	Author  Author
+	// Logo is either a path of a static file or an absolute URL
+	Logo  string
+	Links []Link
+	// About holds the about page, rendered from the configured markdown file
+	About []byte
+	// Location is the timezone in which dates are shown and days, months and years begin
+	Location *time.Location
+}
+
+// Load reads the site configuration from viper.
+func Load() (Config, error) {
+	cfg := Config{
+		Title:       viper.GetString("site.title"),
+		Description: viper.GetString("site.description"),
+		BaseURL:     strings.TrimSuffix(viper.GetString("site.base_url"), "/"),
+		Author: Author{
+			Name:  viper.GetString("site.author.name"),
+			Email: viper.GetString("site.author.email"),
+			URL:   viper.GetString("site.author.url"),
+		},
+		Logo: viper.GetString("site.logo"),
+	}
+	if err := viper.UnmarshalKey("site.links", &cfg.Links); err != nil {
+		return Config{}, fmt.Errorf("parsing site links: %w", err)
+	}
+	if _, err := url.Parse(cfg.BaseURL); err != nil {
+		return Config{}, fmt.Errorf("parsing site base URL: %w", err)
+	}
+	loc, err := time.LoadLocation(viper.GetString("site.timezone"))
+	if err != nil {
+		return Config{}, fmt.Errorf("loading site timezone: %w", err)
+	}
+	cfg.Location = loc
+	if fp := viper.GetString("site.about"); fp != "" {
+		about, err := os.ReadFile(fp)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading about page: %w", err)
+		}
+		cfg.About = about
+	}
+	return cfg, nil
+}
+
+// URL returns the absolute URL of 'path' on the site.
+func (c Config) URL(path string) string {
+	return c.BaseURL + "/" + strings.TrimPrefix(path, "/")
+}
+
+// Domain returns the host part of the site's base URL.
+func (c Config) Domain() string {
+	u, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}